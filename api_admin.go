@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isAdmin checks for the ADMIN_KEY api key. Without one set the admin
+// endpoints are off.
+func (apiCfg *apiConfig) isAdmin(req *http.Request) bool {
+	apiKey := strings.TrimPrefix(req.Header.Get("Authorization"), "ApiKey ")
+	return apiCfg.adminKey != "" && apiKey == apiCfg.adminKey
+}
+
+// maxRestoreBytes caps the size of a backup posted to /admin/restore
+const maxRestoreBytes = 1 << 30
+
+// backup sends a sealed backup, or a plaintext one with ?plaintext=true. Like
+// the backup command it won't hand out every password hash and refresh token
+// in the clear unless asked to.
+func (apiCfg *apiConfig) backup(w http.ResponseWriter, req *http.Request) {
+	if !apiCfg.isAdmin(req) {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// a sealed backup is written to a buffer first, so a missing key can
+	// still get a proper error response
+	plaintext := req.URL.Query().Get("plaintext") == "true"
+	sealed := bytes.Buffer{}
+	if !plaintext {
+		err := apiCfg.store.BackupSealed(&sealed)
+		if errors.Is(err, errNoKey) {
+			respondWithError(w, http.StatusBadRequest, "no DB_ENCRYPTION_KEY is configured, ask for ?plaintext=true")
+			return
+		} else if err != nil {
+			log.Printf("failed to back up: %s", err)
+			respondWithError(w, http.StatusInternalServerError, "server error")
+			return
+		}
+	}
+
+	name := fmt.Sprintf("backup-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+	if !plaintext {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.enc"`, name))
+		w.Write(sealed.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	err := apiCfg.store.Backup(w)
+	if err != nil {
+		// nothing has been written if taking the snapshot failed
+		log.Printf("failed to back up: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+}
+
+func (apiCfg *apiConfig) restore(w http.ResponseWriter, req *http.Request) {
+	if !apiCfg.isAdmin(req) {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	err := apiCfg.store.Restore(http.MaxBytesReader(w, req.Body, maxRestoreBytes))
+	tooLarge := &http.MaxBytesError{}
+	if errors.As(err, &tooLarge) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "backup is too large")
+		return
+	} else if errors.Is(err, ErrInvalidSnapshot) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("failed to restore: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// streamEvents sends change events as server-sent events. The event id is the
+// seq, so a client that reconnects with Last-Event-ID (or ?after=$seq) picks
+// up where it left off. Without either it only gets new events.
+func (apiCfg *apiConfig) streamEvents(w http.ResponseWriter, req *http.Request) {
+	if !apiCfg.isAdmin(req) {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	seq := LatestEvent
+	after := req.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = req.URL.Query().Get("after")
+	}
+	if after != "" {
+		var err error
+		seq, err = strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid event id")
+			return
+		}
+	}
+
+	sub, err := apiCfg.store.Subscribe(seq)
+	if errors.Is(err, ErrEventsGone) {
+		respondWithError(w, http.StatusGone, "events are gone, resync and subscribe without an id")
+		return
+	} else if err != nil {
+		log.Printf("failed to subscribe: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	send := func(event Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s.%s\ndata: %s\n\n", event.Seq, event.Entity, event.Op, data)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	for _, event := range sub.Backlog {
+		if send(event) != nil {
+			return
+		}
+	}
+	rc.Flush()
+
+	// keeps proxies from timing out a quiet stream
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				// dropped for falling behind, the client reconnects and resumes
+				return
+			}
+			if send(event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			if err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -1,33 +1,24 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
-func (db *DB) revokeRefresh(w http.ResponseWriter, req *http.Request) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
+func (apiCfg *apiConfig) revokeRefresh(w http.ResponseWriter, req *http.Request) {
 	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
 
-	users, err := db.loadDB()
-	if err != nil {
-		log.Printf("failed to get db: %s", err)
-		respondWithError(w, http.StatusInternalServerError, "server error")
-		return
-	}
-
-	if _, ok := users.RefreshTokens[token]; !ok {
+	err := apiCfg.store.Update(TokensScope, func(tx Tx) error {
+		return tx.DeleteRefreshToken(token)
+	})
+	if errors.Is(err, ErrNotExist) {
 		respondWithError(w, http.StatusNotFound, "invalid token")
 		return
-	}
-	delete(users.RefreshTokens, token)
-	err = db.writeDB(users)
-	if err != nil {
-		log.Printf("failed to write db: %s", err)
+	} else if err != nil {
+		log.Printf("failed to revoke token: %s", err)
 		respondWithError(w, http.StatusInternalServerError, "server error")
 		return
 	}
@@ -36,53 +27,51 @@ func (db *DB) revokeRefresh(w http.ResponseWriter, req *http.Request) {
 
 }
 
-func (db *DB) refresh(apiCfg apiConfig) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		type Response struct {
-			Token string `json:"token"`
-		}
-
-		db.mux.Lock()
-		defer db.mux.Unlock()
+func (apiCfg *apiConfig) refresh(w http.ResponseWriter, req *http.Request) {
+	type Response struct {
+		Token string `json:"token"`
+	}
 
-		requestToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	requestToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
 
-		users, err := db.loadDB()
+	refreshToken := RefreshToken{}
+	expired := false
+	err := apiCfg.store.Update(TokensScope, func(tx Tx) error {
+		var err error
+		refreshToken, err = tx.RefreshToken(requestToken)
 		if err != nil {
-			log.Printf("failed to get db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
+			return err
 		}
-
-		refreshToken, ok := users.RefreshTokens[requestToken]
-		if !ok {
-			respondWithError(w, http.StatusUnauthorized, "invalid token")
-			return
-		}
-
 		if refreshToken.Expiration < time.Now().Unix() {
 			// keep the db tidy
-			delete(users.RefreshTokens, requestToken)
-			err = db.writeDB(users)
-			if err != nil {
-				log.Printf("failed to write db: %s", err)
-				respondWithError(w, http.StatusInternalServerError, "server error")
-				return
-			}
-			respondWithError(w, http.StatusUnauthorized, "invalid token")
-			return
+			expired = true
+			return tx.DeleteRefreshToken(requestToken)
 		}
+		return nil
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	} else if err != nil {
+		log.Printf("failed to refresh token: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
 
-		currentTime := time.Now()
-		token := apiCfg.generateJWT(currentTime, 0, refreshToken.UserId)
-		if token == "" {
-			respondWithError(w, http.StatusInternalServerError, "server error")
-		}
+	if expired {
+		respondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
 
-		response := Response{
-			Token: token,
-		}
-		respondWithJSON(w, http.StatusOK, response)
+	currentTime := time.Now()
+	token := apiCfg.generateJWT(currentTime, 0, refreshToken.UserId)
+	if token == "" {
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
 	}
 
+	response := Response{
+		Token: token,
+	}
+	respondWithJSON(w, http.StatusOK, response)
 }
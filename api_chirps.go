@@ -2,124 +2,250 @@ package main
 
 import (
 	"encoding/json"
-	"github.com/golang-jwt/jwt/v5"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
+	"time"
 )
 
-func (db *DB) createChirp(apiCfg apiConfig) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		type requestParams struct {
-			Body string `json:"body"`
-		}
+func (apiCfg *apiConfig) createChirp(w http.ResponseWriter, req *http.Request) {
+	type requestParams struct {
+		Body      string `json:"body"`
+		InReplyTo int    `json:"in_reply_to"`
+		RechirpOf int    `json:"rechirp_of"`
+		QuoteOf   int    `json:"quote_of"`
+		// publishes the chirp later if set
+		PublishAt time.Time `json:"publish_at"`
+	}
 
-		db.mux.Lock()
-		defer db.mux.Unlock()
+	userId, ok := apiCfg.requestUserId(req)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 
-		claims := jwt.RegisteredClaims{}
-		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
-		parsedToken, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(apiCfg.jwtSecret), nil
-		})
-		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-			return
+	decoder := json.NewDecoder(req.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(params.Body) > 140 {
+		respondWithError(w, http.StatusBadRequest, "message is too long")
+		return
+	}
+	if params.RechirpOf != 0 && (params.Body != "" || params.InReplyTo != 0 || params.QuoteOf != 0) {
+		respondWithError(w, http.StatusBadRequest, "a rechirp can't have a body or other references")
+		return
+	}
+	if params.QuoteOf != 0 && params.Body == "" {
+		respondWithError(w, http.StatusBadRequest, "a quote needs a body")
+		return
+	}
+	scheduled := !params.PublishAt.IsZero()
+	if scheduled && !params.PublishAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "publish_at must be in the future")
+		return
+	}
+
+	responseBody := Chirp{}
+	err = apiCfg.store.Update(ChirpsScope|ReadOnly(UsersScope), func(tx Tx) error {
+		draft := Chirp{
+			Body:      cleanString(params.Body),
+			AuthorId:  userId,
+			InReplyTo: params.InReplyTo,
+			RechirpOf: params.RechirpOf,
+			QuoteOf:   params.QuoteOf,
+		}
+		var err error
+		if scheduled {
+			responseBody, err = tx.ScheduleChirp(draft, params.PublishAt.UTC())
+		} else {
+			responseBody, err = tx.CreateChirp(draft)
 		}
+		return err
+	})
+	if errors.Is(err, ErrForbidden) {
+		respondWithError(w, http.StatusBadRequest, "rechirps can't be scheduled")
+		return
+	} else if errors.Is(err, ErrBadReference) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if errors.Is(err, ErrAlreadyExists) {
+		respondWithError(w, http.StatusBadRequest, "already rechirped")
+		return
+	} else if err != nil {
+		log.Printf("failed to create chirp: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
 
-		decoder := json.NewDecoder(req.Body)
-		params := requestParams{}
-		err = decoder.Decode(&params)
-		if err != nil {
-			log.Printf("Error decoding: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
+	w.Header().Set("ETag", chirpETag(responseBody))
+	respondWithJSON(w, http.StatusCreated, responseBody)
+}
+
+// the most chirps a single page can hold
+const maxPageSize = 1000
+
+const defaultSearchResults = 20
+
+func (apiCfg *apiConfig) getAllChirps(w http.ResponseWriter, req *http.Request) {
+	apiCfg.listChirps(w, req, ChirpQuery{})
+}
+
+func (apiCfg *apiConfig) getHashtagChirps(w http.ResponseWriter, req *http.Request) {
+	tag := normalizeHashtag(req.PathValue("tag"))
+	if tag == "" {
+		respondWithError(w, http.StatusBadRequest, "invalid hashtag")
+		return
+	}
+
+	apiCfg.listChirps(w, req, ChirpQuery{Hashtag: tag})
+}
+
+func (apiCfg *apiConfig) getMentions(w http.ResponseWriter, req *http.Request) {
+	userId, err := strconv.Atoi(req.PathValue("userID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	apiCfg.listChirps(w, req, ChirpQuery{MentionOf: userId})
+}
+
+// listChirps narrows q down with the query params every chirp feed takes
+// (author_id, since, until, sort, limit and cursor) and responds with that
+// page
+func (apiCfg *apiConfig) listChirps(w http.ResponseWriter, req *http.Request, q ChirpQuery) {
+	query := req.URL.Query()
+	q.Desc = query.Get("sort") == "desc"
+
+	var err error
+	if query.Has("author_id") {
+		q.AuthorId, err = strconv.Atoi(query.Get("author_id"))
+		if err != nil || q.AuthorId < 1 {
+			respondWithError(w, http.StatusBadRequest, "invalid author id")
 			return
 		}
-
-		if len(params.Body) > 140 {
-			respondWithError(w, http.StatusBadRequest, "message is too long")
+	}
+	if query.Has("since") {
+		q.Since, err = time.Parse(time.RFC3339, query.Get("since"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "since must be an RFC 3339 time")
 			return
 		}
-
-		chirps, err := db.loadDB()
+	}
+	if query.Has("until") {
+		q.Until, err = time.Parse(time.RFC3339, query.Get("until"))
 		if err != nil {
-			log.Printf("failed to get chirps: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
+			respondWithError(w, http.StatusBadRequest, "until must be an RFC 3339 time")
 			return
 		}
-		chirps.ChirpId++
-		chirpId := chirps.ChirpId
-
-		temp, _ := parsedToken.Claims.GetSubject()
-		userId, _ := strconv.Atoi(temp)
-		responseBody := Chirp{
-			Id:       chirpId,
-			Body:     cleanString(params.Body),
-			AuthorId: userId,
+	}
+	if query.Has("limit") {
+		q.Limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
 		}
-		chirps.Chirps[chirpId] = responseBody
-
-		err = db.writeDB(chirps)
-		if err != nil {
-			log.Printf("failed to write db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
+	}
+	if query.Has("cursor") {
+		q.After, err = strconv.Atoi(query.Get("cursor"))
+		if err != nil || q.After < 1 {
+			respondWithError(w, http.StatusBadRequest, "invalid cursor")
 			return
 		}
-
-		respondWithJSON(w, http.StatusCreated, responseBody)
 	}
-}
 
-func (db *DB) getAllChirps(w http.ResponseWriter, req *http.Request) {
-	authorIdString := req.URL.Query().Get("author_id")
-	sort := req.URL.Query().Get("sort")
-
-	allChirps, err := db.GetChirps()
-	if err != nil {
+	chirps := []Chirp{}
+	more := false
+	scope := ChirpsScope
+	if q.MentionOf != 0 {
+		scope |= UsersScope
+	}
+	err = apiCfg.store.View(scope, func(tx Tx) error {
+		if q.MentionOf != 0 {
+			_, err := tx.User(q.MentionOf)
+			if err != nil {
+				return err
+			}
+		}
+		chirps, more = tx.Chirps(q)
+		return nil
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if err != nil {
 		log.Printf("failed to get chirps: %s", err)
 		respondWithError(w, http.StatusInternalServerError, "server error")
 		return
 	}
 
-	if authorIdString == "" {
-		if sort == "desc" {
-			respondWithJSON(w, http.StatusOK, reverseChirps(allChirps))
-		} else {
-			respondWithJSON(w, http.StatusOK, allChirps)
-		}
-		return
+	if more {
+		// the cursor is the last id on this page, but clients should just
+		// follow the link
+		query.Set("cursor", strconv.Itoa(chirps[len(chirps)-1].Id))
+		next := url.URL{Path: req.URL.Path, RawQuery: query.Encode()}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
 	}
+	respondWithJSON(w, http.StatusOK, chirps)
+}
 
-	authorId, err := strconv.Atoi(authorIdString)
+func (apiCfg *apiConfig) searchChirps(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	q, err := parseSearch(query.Get("q"))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "invalid author id")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	chirps := []Chirp{}
-	for _, chirp := range allChirps {
-		if authorId == chirp.AuthorId {
-			chirps = append(chirps, chirp)
+
+	switch query.Get("order") {
+	case "", "relevance":
+	case "recent":
+		q.Recent = true
+	default:
+		respondWithError(w, http.StatusBadRequest, "order must be relevance or recent")
+		return
+	}
+	if query.Has("author_id") {
+		q.AuthorId, err = strconv.Atoi(query.Get("author_id"))
+		if err != nil || q.AuthorId < 1 {
+			respondWithError(w, http.StatusBadRequest, "invalid author id")
+			return
 		}
 	}
-	if sort == "desc" {
-		respondWithJSON(w, http.StatusOK, reverseChirps(chirps))
-	} else {
-		respondWithJSON(w, http.StatusOK, chirps)
+	q.Limit = defaultSearchResults
+	if query.Has("limit") {
+		q.Limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
 	}
-}
 
-func (db *DB) getChirp(w http.ResponseWriter, req *http.Request) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-
-	chirps, err := db.loadDB()
+	chirps := []Chirp{}
+	err = apiCfg.store.View(ChirpsScope, func(tx Tx) error {
+		chirps = tx.SearchChirps(q)
+		return nil
+	})
 	if err != nil {
-		log.Printf("failed to get chirps: %s", err)
+		log.Printf("failed to search chirps: %s", err)
 		respondWithError(w, http.StatusInternalServerError, "server error")
 		return
 	}
 
+	respondWithJSON(w, http.StatusOK, chirps)
+}
+
+func (apiCfg *apiConfig) getChirp(w http.ResponseWriter, req *http.Request) {
 	id, err := strconv.Atoi(req.PathValue("chirpID"))
 	if err != nil {
 		log.Printf("failed to convert id to int: %s", err)
@@ -127,73 +253,204 @@ func (db *DB) getChirp(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if data, ok := chirps.Chirps[id]; ok {
-		respondWithJSON(w, http.StatusOK, data)
+	data := Chirp{}
+	err = apiCfg.store.View(ChirpsScope, func(tx Tx) error {
+		var err error
+		data, err = tx.Chirp(id)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if err != nil {
+		log.Printf("failed to get chirps: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
 		return
 	}
 
-	respondWithError(w, http.StatusNotFound, "Id does not exist")
+	w.Header().Set("ETag", chirpETag(data))
+	if etagMatches(req.Header.Get("If-None-Match"), chirpETag(data)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, data)
 }
 
-func (db *DB) deleteChirp(apiCfg apiConfig) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		db.mux.Lock()
-		defer db.mux.Unlock()
+func (apiCfg *apiConfig) updateChirp(w http.ResponseWriter, req *http.Request) {
+	type requestParams struct {
+		Body string `json:"body"`
+	}
 
-		claims := jwt.RegisteredClaims{}
-		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
-		parsedToken, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(apiCfg.jwtSecret), nil
-		})
-		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-			return
-		}
+	tokenUserId, ok := apiCfg.requestUserId(req)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	chirpId, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := requestParams{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
 
-		temp, _ := parsedToken.Claims.GetSubject()
-		tokenUserId, _ := strconv.Atoi(temp)
+	if len(params.Body) > 140 {
+		respondWithError(w, http.StatusBadRequest, "message is too long")
+		return
+	}
+	// only rechirps go without a body, and they can't be edited
+	if params.Body == "" {
+		respondWithError(w, http.StatusBadRequest, "body can't be empty")
+		return
+	}
 
-		chirps, err := db.loadDB()
+	chirp := Chirp{}
+	err = apiCfg.store.Update(ChirpsScope|ReadOnly(UsersScope), func(tx Tx) error {
+		var err error
+		chirp, err = tx.Chirp(chirpId)
 		if err != nil {
-			log.Printf("failed to get chirps: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
+			return err
 		}
-
-		chirpId, err := strconv.Atoi(req.PathValue("chirpID"))
+		if tokenUserId != chirp.AuthorId {
+			return ErrForbidden
+		}
+		err = checkIfMatch(req, chirp.Version)
 		if err != nil {
-			log.Printf("failed to convert id to int: %s", err)
-			respondWithError(w, http.StatusBadRequest, "Invalid id")
-			return
+			return err
 		}
+		chirp.Body = cleanString(params.Body)
+		chirp, err = tx.UpdateChirp(chirp)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if errors.Is(err, ErrForbidden) {
+		respondWithError(w, http.StatusForbidden, "Forbidden")
+		return
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		respondWithError(w, http.StatusPreconditionFailed, "chirp has changed")
+		return
+	} else if err != nil {
+		log.Printf("failed to update chirp: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
 
-		if _, ok := chirps.Chirps[chirpId]; !ok {
-			respondWithError(w, http.StatusNotFound, "Id does not exist")
-			return
-		}
+	w.Header().Set("ETag", chirpETag(chirp))
+	respondWithJSON(w, http.StatusOK, chirp)
+}
 
-		if tokenUserId != chirps.Chirps[chirpId].AuthorId {
-			respondWithError(w, http.StatusForbidden, "Forbidden")
-			return
-		}
+// getChirpHistory lists every revision of a chirp, oldest first and ending
+// with the current one
+func (apiCfg *apiConfig) getChirpHistory(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
 
-		delete(chirps.Chirps, chirpId)
-		err = db.writeDB(chirps)
+	revisions := []ChirpRevision{}
+	err = apiCfg.store.View(ChirpsScope, func(tx Tx) error {
+		chirp, err := tx.Chirp(id)
 		if err != nil {
-			log.Printf("failed to write db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
+			return err
 		}
+		revisions, err = tx.ChirpHistory(id)
+		revisions = append(revisions, ChirpRevision{Version: chirp.Version, Body: chirp.Body})
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if err != nil {
+		log.Printf("failed to get chirp history: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, revisions)
+}
 
-		w.WriteHeader(http.StatusNoContent)
+// getThread returns the conversation a chirp belongs to as a tree, starting
+// from the chirp that began it
+func (apiCfg *apiConfig) getThread(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	thread := ThreadNode{}
+	err = apiCfg.store.View(ChirpsScope, func(tx Tx) error {
+		var err error
+		thread, err = tx.Thread(id)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if err != nil {
+		log.Printf("failed to get thread: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
 	}
+
+	respondWithJSON(w, http.StatusOK, thread)
 }
 
-func reverseChirps(allChirps []Chirp) []Chirp {
-	chirps := []Chirp{}
-	for i := len(allChirps) - 1; i >= 0; i-- {
-		chirps = append(chirps, allChirps[i])
+func (apiCfg *apiConfig) deleteChirp(w http.ResponseWriter, req *http.Request) {
+	tokenUserId, ok := apiCfg.requestUserId(req)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	chirpId, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	err = apiCfg.store.Update(ChirpsScope, func(tx Tx) error {
+		chirp, err := tx.Chirp(chirpId)
+		if err != nil {
+			return err
+		}
+		if tokenUserId != chirp.AuthorId {
+			return ErrForbidden
+		}
+		err = checkIfMatch(req, chirp.Version)
+		if err != nil {
+			return err
+		}
+		return tx.DeleteChirp(chirpId)
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if errors.Is(err, ErrForbidden) {
+		respondWithError(w, http.StatusForbidden, "Forbidden")
+		return
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		respondWithError(w, http.StatusPreconditionFailed, "chirp has changed")
+		return
+	} else if err != nil {
+		log.Printf("failed to delete chirp: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
 	}
 
-	return chirps
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+var nextLink = regexp.MustCompile(`^<(.+)>; rel="next"$`)
+
+// getChirpIds runs handler on target and returns the ids it answered with and
+// the target of its next link, "" if there is none
+func getChirpIds(t *testing.T, handler http.HandlerFunc, target string) ([]int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %d %s", target, rec.Code, rec.Body.String())
+	}
+	chirps := []Chirp{}
+	err := json.Unmarshal(rec.Body.Bytes(), &chirps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.Id)
+	}
+
+	link := rec.Header().Get("Link")
+	if link == "" {
+		return ids, ""
+	}
+	match := nextLink.FindStringSubmatch(link)
+	if match == nil {
+		t.Fatalf("GET %s: malformed Link header %q", target, link)
+	}
+	return ids, match[1]
+}
+
+func postChirps(t *testing.T, apiCfg *apiConfig, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if code := postChirp(apiCfg, body); code != http.StatusCreated {
+			t.Fatalf("posting %q: got %d", body, code)
+		}
+	}
+}
+
+func TestListChirpsPages(t *testing.T) {
+	apiCfg := newTestAPI(t)
+	postChirps(t, apiCfg, "one", "two", "three", "four", "five")
+
+	tests := []struct {
+		name  string
+		first string
+		pages [][]int
+		links []string
+	}{
+		{"ascending", "/api/chirps?limit=2", [][]int{{1, 2}, {3, 4}, {5}}, []string{"/api/chirps?cursor=2&limit=2", "/api/chirps?cursor=4&limit=2"}},
+		{"descending", "/api/chirps?limit=2&sort=desc", [][]int{{5, 4}, {3, 2}, {1}}, []string{"/api/chirps?cursor=4&limit=2&sort=desc", "/api/chirps?cursor=2&limit=2&sort=desc"}},
+		{"exact last page", "/api/chirps?limit=5", [][]int{{1, 2, 3, 4, 5}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := test.first
+			for i, want := range test.pages {
+				ids, next := getChirpIds(t, apiCfg.getAllChirps, target)
+				if !slices.Equal(ids, want) {
+					t.Errorf("page %d: got %v, want %v", i+1, ids, want)
+				}
+				wantNext := ""
+				if i < len(test.links) {
+					wantNext = test.links[i]
+				}
+				if next != wantNext {
+					t.Fatalf("page %d: next link %q, want %q", i+1, next, wantNext)
+				}
+				target = next
+			}
+		})
+	}
+}
+
+// The cursor is an id, not an offset: deleting chirps on pages already read,
+// or the very chirp the cursor names, doesn't skip or repeat anything.
+func TestListChirpsPagesAcrossDeletes(t *testing.T) {
+	apiCfg := newTestAPI(t)
+	postChirps(t, apiCfg, "one", "two", "three", "four", "five")
+
+	ids, next := getChirpIds(t, apiCfg.getAllChirps, "/api/chirps?limit=2")
+	if !slices.Equal(ids, []int{1, 2}) {
+		t.Fatalf("first page: got %v", ids)
+	}
+	err := apiCfg.store.Update(ChirpsScope, func(tx Tx) error {
+		for _, id := range []int{1, 2} {
+			err := tx.DeleteChirp(id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, next = getChirpIds(t, apiCfg.getAllChirps, next)
+	if !slices.Equal(ids, []int{3, 4}) {
+		t.Errorf("second page: got %v, want [3 4]", ids)
+	}
+	ids, next = getChirpIds(t, apiCfg.getAllChirps, next)
+	if !slices.Equal(ids, []int{5}) || next != "" {
+		t.Errorf("last page: got %v and link %q, want [5] and none", ids, next)
+	}
+}
+
+func TestSearchChirps(t *testing.T) {
+	apiCfg := newTestAPI(t)
+	postChirps(t, apiCfg,
+		"the build is green",
+		"green build today",
+		"the build broke",
+		"build the thing",
+		"coffee, then the build",
+	)
+
+	tests := []struct {
+		q    string
+		want []int
+	}{
+		// every word, anywhere and in any case
+		{`build green`, []int{2, 1}},
+		{`BUILD`, []int{5, 4, 3, 2, 1}},
+		// the words of a phrase next to each other, in order
+		{`"the build"`, []int{5, 3, 1}},
+		{`coffee "the build"`, []int{5}},
+		{`"build the" green`, []int{}},
+		{`deploy`, []int{}},
+	}
+	for _, test := range tests {
+		target := "/api/chirps/search?" + url.Values{"q": {test.q}, "order": {"recent"}}.Encode()
+		ids, _ := getChirpIds(t, apiCfg.searchChirps, target)
+		if !slices.Equal(ids, test.want) {
+			t.Errorf("q=%s: got %v, want %v", test.q, ids, test.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	apiCfg.searchChirps(rec, httptest.NewRequest(http.MethodGet, `/api/chirps/search?q=%22%22`, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("empty search: got %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+func (apiCfg *apiConfig) likeChirp(w http.ResponseWriter, req *http.Request) {
+	apiCfg.changeLike(w, req, Tx.LikeChirp)
+}
+
+func (apiCfg *apiConfig) unlikeChirp(w http.ResponseWriter, req *http.Request) {
+	apiCfg.changeLike(w, req, Tx.UnlikeChirp)
+}
+
+// changeLike likes or unlikes a chirp for the user in the JWT and returns the
+// chirp with its new like count. Doing either twice is the same as once.
+func (apiCfg *apiConfig) changeLike(w http.ResponseWriter, req *http.Request, change func(tx Tx, chirpId int, userId int) error) {
+	tokenUserId, ok := apiCfg.requestUserId(req)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	chirpId, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	chirp := Chirp{}
+	err = apiCfg.store.Update(ChirpsScope, func(tx Tx) error {
+		err := change(tx, chirpId, tokenUserId)
+		if err != nil {
+			return err
+		}
+		chirp, err = tx.Chirp(chirpId)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if err != nil {
+		log.Printf("failed to change like: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+func (apiCfg *apiConfig) getLikedChirps(w http.ResponseWriter, req *http.Request) {
+	userId, err := strconv.Atoi(req.PathValue("userID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	chirps := []Chirp{}
+	err = apiCfg.store.View(ChirpsScope|UsersScope, func(tx Tx) error {
+		_, err := tx.User(userId)
+		if err != nil {
+			return err
+		}
+		chirps = tx.LikedChirps(userId)
+		return nil
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if err != nil {
+		log.Printf("failed to get liked chirps: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if req.URL.Query().Get("sort") == "desc" {
+		slices.Reverse(chirps)
+	}
+	respondWithJSON(w, http.StatusOK, chirps)
+}
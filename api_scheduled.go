@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// getScheduledChirps lists the chirps the user in the JWT has queued, the
+// next one to go out first
+func (apiCfg *apiConfig) getScheduledChirps(w http.ResponseWriter, req *http.Request) {
+	userId, ok := apiCfg.requestUserId(req)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	chirps := []Chirp{}
+	err := apiCfg.store.View(ChirpsScope, func(tx Tx) error {
+		chirps = tx.ScheduledChirps(userId)
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to get scheduled chirps: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirps)
+}
+
+func (apiCfg *apiConfig) rescheduleChirp(w http.ResponseWriter, req *http.Request) {
+	type requestParams struct {
+		PublishAt time.Time `json:"publish_at"`
+	}
+
+	userId, ok := apiCfg.requestUserId(req)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	scheduledId, err := strconv.Atoi(req.PathValue("scheduledID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := requestParams{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if !params.PublishAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "publish_at must be in the future")
+		return
+	}
+
+	chirp := Chirp{}
+	err = apiCfg.store.Update(ChirpsScope, func(tx Tx) error {
+		var err error
+		chirp, err = tx.ScheduledChirp(scheduledId)
+		// other users don't get to know it exists
+		if err != nil || chirp.AuthorId != userId {
+			return ErrNotExist
+		}
+		err = checkIfMatch(req, chirp.Version)
+		if err != nil {
+			return err
+		}
+		chirp, err = tx.RescheduleChirp(scheduledId, params.PublishAt.UTC())
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		respondWithError(w, http.StatusPreconditionFailed, "chirp has changed")
+		return
+	} else if err != nil {
+		log.Printf("failed to reschedule chirp: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	w.Header().Set("ETag", chirpETag(chirp))
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+func (apiCfg *apiConfig) cancelScheduledChirp(w http.ResponseWriter, req *http.Request) {
+	userId, ok := apiCfg.requestUserId(req)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	scheduledId, err := strconv.Atoi(req.PathValue("scheduledID"))
+	if err != nil {
+		log.Printf("failed to convert id to int: %s", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	err = apiCfg.store.Update(ChirpsScope, func(tx Tx) error {
+		chirp, err := tx.ScheduledChirp(scheduledId)
+		if err != nil || chirp.AuthorId != userId {
+			return ErrNotExist
+		}
+		return tx.UnscheduleChirp(scheduledId)
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Id does not exist")
+		return
+	} else if err != nil {
+		log.Printf("failed to cancel chirp: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
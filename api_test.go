@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestAPI(t *testing.T) *apiConfig {
+	t.Helper()
+	store := NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+	password, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(UsersScope, func(tx Tx) error {
+		_, err := tx.CreateUser("ada@example.com", password)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &apiConfig{jwtSecret: "secret", store: store, maintenance: newMaintenanceStats()}
+}
+
+func postChirp(apiCfg *apiConfig, body string) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/chirps", strings.NewReader(fmt.Sprintf(`{"body":%q}`, body)))
+	req.Header.Set("Authorization", "Bearer "+apiCfg.generateJWT(time.Now(), 0, 1))
+	rec := httptest.NewRecorder()
+	apiCfg.createChirp(rec, req)
+	return rec.Code
+}
+
+// A login reads the user and then saves a refresh token. Neither may hold up
+// posting a chirp.
+func TestLoginDoesNotBlockChirps(t *testing.T) {
+	apiCfg := newTestAPI(t)
+
+	for _, held := range []struct {
+		name string
+		hold func(fn func(tx Tx) error) error
+	}{
+		{"reading the user", func(fn func(tx Tx) error) error { return apiCfg.store.View(UsersScope, fn) }},
+		{"saving the refresh token", func(fn func(tx Tx) error) error { return apiCfg.store.Update(TokensScope, fn) }},
+	} {
+		inside := make(chan struct{})
+		release := make(chan struct{})
+		go held.hold(func(tx Tx) error {
+			close(inside)
+			<-release
+			return nil
+		})
+		waitFor(t, inside, held.name)
+
+		posted := make(chan struct{})
+		go func() {
+			defer close(posted)
+			if code := postChirp(apiCfg, "while "+held.name); code != http.StatusCreated {
+				t.Errorf("posting while %s: got %d", held.name, code)
+			}
+		}()
+		waitFor(t, posted, "posting a chirp while "+held.name)
+		close(release)
+	}
+}
+
+func adminRequest(method string, target string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Authorization", "ApiKey admin")
+	return req
+}
+
+func TestAdminBackupIsSealed(t *testing.T) {
+	apiCfg := newTestAPI(t)
+	apiCfg.adminKey = "admin"
+
+	// the memory store has no key, so only an explicit plaintext backup works
+	rec := httptest.NewRecorder()
+	apiCfg.backup(rec, adminRequest(http.MethodGet, "/admin/backup", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("backup without a key: got %d, want 400", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	apiCfg.backup(rec, adminRequest(http.MethodGet, "/admin/backup?plaintext=true", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "ada@example.com") {
+		t.Errorf("plaintext backup: got %d %q", rec.Code, rec.Body.String())
+	}
+
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), DBOptions{EncryptionKey: testKey(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Restore(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiCfg.store = db
+	rec = httptest.NewRecorder()
+	apiCfg.backup(rec, adminRequest(http.MethodGet, "/admin/backup", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), encryptedPrefix) {
+		t.Fatalf("backup with a key: got %d %.20q, want it sealed", rec.Code, rec.Body.String())
+	}
+
+	sealed := rec.Body.Bytes()
+	rec = httptest.NewRecorder()
+	apiCfg.restore(rec, adminRequest(http.MethodPost, "/admin/restore", sealed))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("restoring the sealed backup: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+// A validly signed token whose subject isn't a user id must not act as user 0.
+func TestTokenWithoutUserIdIsUnauthorized(t *testing.T) {
+	apiCfg := newTestAPI(t)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "ada",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString([]byte(apiCfg.jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/chirps", strings.NewReader(`{"body":"hello"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	apiCfg.createChirp(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("create chirp = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/api/users", strings.NewReader(`{"email":"eve@example.com","password":"x"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	apiCfg.updateUser(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("update user = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
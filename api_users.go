@@ -3,11 +3,9 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -19,262 +17,244 @@ type UserRequestParams struct {
 }
 
 type Response struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"created_at,omitzero"`
+	UpdatedAt   time.Time `json:"updated_at,omitzero"`
 }
 
-func (db *DB) createUser(w http.ResponseWriter, req *http.Request) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
+func (apiCfg *apiConfig) createUser(w http.ResponseWriter, req *http.Request) {
 	params, err := checkRequest(w, req)
 	if err != nil {
 		log.Printf("params check failed: %v", err)
 		return
 	}
 
-	users, err := db.loadDB()
-	if err != nil {
-		log.Printf("failed to get db: %s", err)
-		respondWithError(w, http.StatusInternalServerError, "server error")
-		return
-	}
-	if _, ok := users.Emails[params.Email]; ok {
-		respondWithError(w, http.StatusBadRequest, "invalid request")
-		return
-	}
-	users.UserId++
-	id := users.UserId
-	responseBody := Response{
-		Id:          id,
-		Email:       params.Email,
-		IsChirpyRed: false,
-	}
 	password, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Printf("failed to generate password: %s", err)
 		respondWithError(w, http.StatusInternalServerError, "server error")
 		return
 	}
-	users.Users[id] = User{
-		Id:          id,
-		Email:       params.Email,
-		Password:    password,
-		IsChirpyRed: false,
-	}
-	users.Emails[responseBody.Email] = id
 
-	err = db.writeDB(users)
-	if err != nil {
-		log.Printf("failed to write db: %s", err)
+	user := User{}
+	err = apiCfg.store.Update(UsersScope, func(tx Tx) error {
+		var err error
+		user, err = tx.CreateUser(params.Email, password)
+		return err
+	})
+	if errors.Is(err, ErrAlreadyExists) {
+		respondWithError(w, http.StatusBadRequest, "invalid request")
+		return
+	} else if err != nil {
+		log.Printf("failed to create user: %s", err)
 		respondWithError(w, http.StatusInternalServerError, "server error")
 		return
 	}
 
+	responseBody := Response{
+		Id:          user.Id,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		Version:     user.Version,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	}
+	w.Header().Set("ETag", etag(user.Version))
 	respondWithJSON(w, http.StatusCreated, responseBody)
 }
 
-func (db *DB) userLogin(apiCfg apiConfig) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		type Response struct {
-			Id           int    `json:"id"`
-			Email        string `json:"email"`
-			IsChirpyRed  bool   `json:"is_chirpy_red"`
-			Token        string `json:"token"`
-			RefreshToken string `json:"refresh_token"`
-		}
-
-		db.mux.Lock()
-		defer db.mux.Unlock()
-
-		params, err := checkRequest(w, req)
-		if err != nil {
-			log.Printf("params check failed: %v", err)
-			return
-		}
+func (apiCfg *apiConfig) userLogin(w http.ResponseWriter, req *http.Request) {
+	type Response struct {
+		Id           int       `json:"id"`
+		Email        string    `json:"email"`
+		IsChirpyRed  bool      `json:"is_chirpy_red"`
+		Version      int       `json:"version"`
+		CreatedAt    time.Time `json:"created_at,omitzero"`
+		UpdatedAt    time.Time `json:"updated_at,omitzero"`
+		Token        string    `json:"token"`
+		RefreshToken string    `json:"refresh_token"`
+	}
 
-		users, err := db.loadDB()
-		if err != nil {
-			log.Printf("failed to get db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
-		}
+	params, err := checkRequest(w, req)
+	if err != nil {
+		log.Printf("params check failed: %v", err)
+		return
+	}
 
-		id, ok := users.Emails[params.Email]
-		if !ok {
-			respondWithError(w, http.StatusBadRequest, "invalid request")
-			return
-		}
+	user := User{}
+	err = apiCfg.store.View(UsersScope, func(tx Tx) error {
+		var err error
+		user, err = tx.UserByEmail(params.Email)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusBadRequest, "invalid request")
+		return
+	} else if err != nil {
+		log.Printf("failed to get user: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
 
-		result := bcrypt.CompareHashAndPassword(users.Users[id].Password, []byte(params.Password))
-		if result != nil {
-			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-			return
-		}
+	result := bcrypt.CompareHashAndPassword(user.Password, []byte(params.Password))
+	if result != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 
-		currentTime := time.Now()
+	currentTime := time.Now()
 
-		token := apiCfg.generateJWT(currentTime, params.Expires, id)
-		if token == "" {
-			respondWithError(w, http.StatusInternalServerError, "server error")
-		}
+	token := apiCfg.generateJWT(currentTime, params.Expires, user.Id)
+	if token == "" {
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
 
-		refreshToken := generateRefreshToken()
-		users.RefreshTokens[refreshToken] = RefreshToken{
-			UserId:     id,
+	refreshToken := generateRefreshToken()
+	err = apiCfg.store.Update(TokensScope, func(tx Tx) error {
+		return tx.SaveRefreshToken(refreshToken, RefreshToken{
+			UserId:     user.Id,
 			Expiration: currentTime.Unix() + 5184000,
-		}
-
-		err = db.writeDB(users)
-		if err != nil {
-			log.Printf("failed to write db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
-		}
-
-		response := Response{
-			Id:           id,
-			Email:        users.Users[id].Email,
-			IsChirpyRed:  users.Users[id].IsChirpyRed,
-			Token:        token,
-			RefreshToken: refreshToken,
-		}
-		respondWithJSON(w, http.StatusOK, response)
+		})
+	})
+	if err != nil {
+		log.Printf("failed to save token: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
 	}
 
+	response := Response{
+		Id:           user.Id,
+		Email:        user.Email,
+		IsChirpyRed:  user.IsChirpyRed,
+		Version:      user.Version,
+		CreatedAt:    user.CreatedAt,
+		UpdatedAt:    user.UpdatedAt,
+		Token:        token,
+		RefreshToken: refreshToken,
+	}
+	w.Header().Set("ETag", etag(user.Version))
+	respondWithJSON(w, http.StatusOK, response)
 }
 
-func (db *DB) updateUser(apiCfg apiConfig) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		db.mux.Lock()
-		defer db.mux.Unlock()
-
-		claims := jwt.RegisteredClaims{}
-		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
-		parsedToken, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(apiCfg.jwtSecret), nil
-		})
-		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-			return
-		}
-
-		params, err := checkRequest(w, req)
-		if err != nil {
-			log.Printf("params check failed: %v", err)
-			return
-		}
+func (apiCfg *apiConfig) updateUser(w http.ResponseWriter, req *http.Request) {
+	id, ok := apiCfg.requestUserId(req)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 
-		stringId, _ := parsedToken.Claims.GetSubject()
-		id, _ := strconv.Atoi(stringId)
+	params, err := checkRequest(w, req)
+	if err != nil {
+		log.Printf("params check failed: %v", err)
+		return
+	}
 
-		users, err := db.loadDB()
-		if err != nil {
-			log.Printf("failed to get db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
-		}
+	password, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("failed to generate password: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
 
-		responseBody := Response{
-			Id:          id,
-			Email:       params.Email,
-			IsChirpyRed: users.Users[id].IsChirpyRed,
-		}
-		password, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
+	user := User{}
+	err = apiCfg.store.Update(UsersScope, func(tx Tx) error {
+		var err error
+		user, err = tx.User(id)
 		if err != nil {
-			log.Printf("failed to generate password: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
-		}
-		oldEmail := users.Users[id].Email
-
-		users.Users[id] = User{
-			Id:          id,
-			Email:       params.Email,
-			Password:    password,
-			IsChirpyRed: users.Users[id].IsChirpyRed,
+			return err
 		}
-
-		// keep the email map clean, so it doesn't cause issues
-		if oldEmail != params.Email {
-			delete(users.Emails, oldEmail)
-			users.Emails[params.Email] = id
-		}
-
-		err = db.writeDB(users)
+		err = checkIfMatch(req, user.Version)
 		if err != nil {
-			log.Printf("failed to write db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
+			return err
 		}
-
-		respondWithJSON(w, http.StatusOK, responseBody)
-
+		user.Email = params.Email
+		user.Password = password
+		user, err = tx.UpdateUser(user)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	} else if errors.Is(err, ErrAlreadyExists) {
+		respondWithError(w, http.StatusBadRequest, "invalid request")
+		return
+	} else if errors.Is(err, ErrPreconditionFailed) {
+		respondWithError(w, http.StatusPreconditionFailed, "user has changed")
+		return
+	} else if err != nil {
+		log.Printf("failed to update user: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
 	}
-}
-
-func (db *DB) polkaWebhook(apiCfg apiConfig) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		type requestParams struct {
-			Event string         `json:"event"`
-			Data  map[string]int `json:"data"`
-		}
-
-		apiKey := strings.TrimPrefix(req.Header.Get("Authorization"), "ApiKey ")
-		if apiKey != apiCfg.polkaKey {
-			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-			return
-		}
 
-		db.mux.Lock()
-		defer db.mux.Unlock()
+	responseBody := Response{
+		Id:          user.Id,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		Version:     user.Version,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	}
+	w.Header().Set("ETag", etag(user.Version))
+	respondWithJSON(w, http.StatusOK, responseBody)
 
-		decoder := json.NewDecoder(req.Body)
-		params := requestParams{}
-		err := decoder.Decode(&params)
-		if err != nil {
-			log.Printf("Error decoding: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
-		}
+}
 
-		if params.Event != "user.upgraded" {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
+func (apiCfg *apiConfig) polkaWebhook(w http.ResponseWriter, req *http.Request) {
+	type requestParams struct {
+		Event string         `json:"event"`
+		Data  map[string]int `json:"data"`
+	}
 
-		users, err := db.loadDB()
-		if err != nil {
-			log.Printf("failed to get db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
-		}
+	apiKey := strings.TrimPrefix(req.Header.Get("Authorization"), "ApiKey ")
+	if apiKey != apiCfg.polkaKey {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 
-		requestUserId, ok := params.Data["user_id"]
-		if !ok {
-			respondWithError(w, http.StatusBadRequest, "user_id doesn't exist in data object")
-			return
-		}
+	decoder := json.NewDecoder(req.Body)
+	params := requestParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
+	}
 
-		if _, ok := users.Users[requestUserId]; !ok {
-			respondWithError(w, http.StatusBadRequest, "invalid user_id")
-			return
-		}
+	if params.Event != "user.upgraded" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
-		tempUser := users.Users[requestUserId]
-		tempUser.IsChirpyRed = true
-		users.Users[requestUserId] = tempUser
+	requestUserId, ok := params.Data["user_id"]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "user_id doesn't exist in data object")
+		return
+	}
 
-		err = db.writeDB(users)
+	err = apiCfg.store.Update(UsersScope, func(tx Tx) error {
+		user, err := tx.User(requestUserId)
 		if err != nil {
-			log.Printf("failed to write db: %s", err)
-			respondWithError(w, http.StatusInternalServerError, "server error")
-			return
+			return err
 		}
-
-		w.WriteHeader(http.StatusNoContent)
+		user.IsChirpyRed = true
+		_, err = tx.UpdateUser(user)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusBadRequest, "invalid user_id")
+		return
+	} else if err != nil {
+		log.Printf("failed to update user: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "server error")
+		return
 	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func checkRequest(w http.ResponseWriter, req *http.Request) (UserRequestParams, error) {
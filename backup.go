@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Backup writes a point in time copy of every collection as a plaintext
+// snapshot. All collections are read locked while it is taken, so it never
+// contains half of a transaction.
+func (db *DB) Backup(w io.Writer) error {
+	release, err := db.lockFiles(false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	unlock := db.lock(AllScopes, false)
+	data, err := json.Marshal(db.data)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// BackupSealed is Backup encrypted with the db's key, for copies that leave
+// the server. It fails if the db isn't encrypted.
+func (db *DB) BackupSealed(w io.Writer) error {
+	if db.cipher == nil {
+		return errNoKey
+	}
+	buf := bytes.Buffer{}
+	err := db.Backup(&buf)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(db.cipher.seal(buf.Bytes()))
+	return err
+}
+
+// Restore replaces everything with the snapshot read from r. The snapshot is
+// migrated and validated first; if it doesn't hold up, or can't be written,
+// the live data is left alone.
+func (db *DB) Restore(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// backups written by BackupSealed, or plaintext ones
+	data, _, err = db.cipher.open(data, true)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	restored, err := decodeBackup(data)
+	if err != nil {
+		return err
+	}
+
+	release, err := db.lockFiles(true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	unlock := db.lock(AllScopes, true)
+	defer unlock()
+	db.journalMux.Lock()
+	defer db.journalMux.Unlock()
+
+	// a crash between the snapshot and the journal truncation must not
+	// replay the old journal on top of the restored data
+	restored.Seq = max(restored.Seq, db.data.Seq)
+
+	old := db.data
+	db.data = restored
+	if db.journal != nil {
+		err = db.compact()
+		if err != nil {
+			db.data = old
+			return err
+		}
+	}
+	// the events so far describe data that is gone
+	db.events.reset()
+	log.Printf("restored backup: %d users, %d chirps", len(restored.Users), len(restored.Chirps))
+
+	return nil
+}
+
+func decodeBackup(data []byte) (DBStructure, error) {
+	data, _, err := runMigrations(data)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	restored := newDBStructure()
+	err = json.Unmarshal(data, &restored)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	err = restored.validate()
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	restored.rebuildIndexes()
+
+	return restored, nil
+}
+
+// validate rejects snapshots that don't pass check, fixable problems
+// included: a backup is supposed to be a copy of a healthy db
+func (s *DBStructure) validate() error {
+	if s.Chirps == nil || s.Users == nil || s.Emails == nil || s.RefreshTokens == nil || s.ChirpHistory == nil || s.Likes == nil || s.Scheduled == nil {
+		return fmt.Errorf("missing collections")
+	}
+	violations := s.check()
+	if len(violations) > 0 {
+		return fmt.Errorf("%s: %s (%d problems in total)", violations[0].Record, violations[0].Detail, len(violations))
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Violation is one broken invariant found by check. Fixable ones can be
+// repaired without guessing at what the data should be, e.g. a counter that
+// is behind or a token for a user that is gone.
+type Violation struct {
+	Check   string `json:"check"`
+	Record  string `json:"record"`
+	Detail  string `json:"detail"`
+	Fixable bool   `json:"fixable"`
+	Fixed   bool   `json:"fixed"`
+	fix     func(s *DBStructure)
+}
+
+// check verifies every invariant between the collections, the email map and
+// the counters. The result is ordered so two runs over the same data compare
+// equal.
+func (s *DBStructure) check() []Violation {
+	violations := []Violation{}
+	report := func(check string, record string, detail string, fix func(s *DBStructure)) {
+		violations = append(violations, Violation{
+			Check:   check,
+			Record:  record,
+			Detail:  detail,
+			Fixable: fix != nil,
+			fix:     fix,
+		})
+	}
+
+	maxChirpId := 0
+	for _, id := range sortedKeys(s.Chirps) {
+		chirp := s.Chirps[id]
+		record := "chirp " + strconv.Itoa(id)
+		maxChirpId = max(maxChirpId, id)
+		if chirp.Id != id {
+			report("chirp-id-mismatch", record, fmt.Sprintf("stored under %d but has id %d", id, chirp.Id), nil)
+		}
+		if _, ok := s.Users[chirp.AuthorId]; !ok {
+			report("chirp-author-missing", record, fmt.Sprintf("author %d does not exist", chirp.AuthorId), nil)
+		}
+	}
+	for _, id := range sortedKeys(s.Chirps) {
+		original := s.Chirps[id].RechirpOf
+		if _, ok := s.Chirps[original]; original != 0 && !ok {
+			// deleting the original takes its rechirps with it
+			report("rechirp-orphaned", "chirp "+strconv.Itoa(id), fmt.Sprintf("rechirps %d which no longer exists", original), func(s *DBStructure) {
+				s.apply(journalEntry{Op: opChirpDeleted, Id: id})
+			})
+		} else if original != 0 && s.Chirps[original].RechirpOf != 0 {
+			// rechirping a rechirp shares its original, and deleting that
+			// only follows one level
+			report("rechirp-of-rechirp", "chirp "+strconv.Itoa(id), fmt.Sprintf("rechirps %d which is a rechirp itself", original), nil)
+		}
+	}
+	if maxChirpId > s.ChirpId {
+		report("chirp-counter-behind", "chirp_id", fmt.Sprintf("counter is %d but chirp %d exists", s.ChirpId, maxChirpId), func(s *DBStructure) {
+			s.ChirpId = maxChirpId
+		})
+	}
+
+	maxScheduledId := 0
+	for _, id := range sortedKeys(s.Scheduled) {
+		chirp := s.Scheduled[id]
+		record := "scheduled chirp " + strconv.Itoa(id)
+		maxScheduledId = max(maxScheduledId, id)
+		if chirp.Id != id {
+			report("chirp-id-mismatch", record, fmt.Sprintf("stored under %d but has id %d", id, chirp.Id), nil)
+		}
+		if _, ok := s.Users[chirp.AuthorId]; !ok {
+			// nobody has seen it yet, so it can go like a token
+			report("scheduled-author-missing", record, fmt.Sprintf("author %d does not exist", chirp.AuthorId), func(s *DBStructure) {
+				delete(s.Scheduled, id)
+			})
+		}
+	}
+	if maxScheduledId > s.ScheduledId {
+		report("scheduled-counter-behind", "scheduled_id", fmt.Sprintf("counter is %d but scheduled chirp %d exists", s.ScheduledId, maxScheduledId), func(s *DBStructure) {
+			s.ScheduledId = maxScheduledId
+		})
+	}
+
+	for _, id := range sortedKeys(s.ChirpHistory) {
+		if _, ok := s.Chirps[id]; !ok {
+			report("history-orphaned", "chirp "+strconv.Itoa(id), "has revisions but no longer exists", func(s *DBStructure) {
+				delete(s.ChirpHistory, id)
+			})
+		}
+	}
+
+	for _, id := range sortedKeys(s.Likes) {
+		record := "likes of chirp " + strconv.Itoa(id)
+		if _, ok := s.Chirps[id]; !ok {
+			report("likes-orphaned", record, "chirp no longer exists", func(s *DBStructure) {
+				s.setLikes(id, nil)
+			})
+			continue
+		}
+		// the likes code binary searches these
+		likers := s.Likes[id]
+		for i := 1; i < len(likers); i++ {
+			if likers[i] <= likers[i-1] {
+				report("likes-unsorted", record, "user ids aren't sorted or appear twice", func(s *DBStructure) {
+					sorted := slices.Clone(s.Likes[id])
+					slices.Sort(sorted)
+					s.setLikes(id, slices.Compact(sorted))
+				})
+				break
+			}
+		}
+		for _, userId := range s.Likes[id] {
+			if _, ok := s.Users[userId]; !ok {
+				report("like-user-missing", record, fmt.Sprintf("user %d does not exist", userId), func(s *DBStructure) {
+					s.apply(journalEntry{Op: opLikeRemoved, Id: id, UserId: userId})
+				})
+			}
+		}
+	}
+
+	maxUserId := 0
+	owners := map[string][]int{}
+	for _, id := range sortedKeys(s.Users) {
+		user := s.Users[id]
+		record := "user " + strconv.Itoa(id)
+		maxUserId = max(maxUserId, id)
+		owners[user.Email] = append(owners[user.Email], id)
+		if user.Id != id {
+			report("user-id-mismatch", record, fmt.Sprintf("stored under %d but has id %d", id, user.Id), nil)
+		}
+	}
+	if maxUserId > s.UserId {
+		report("user-counter-behind", "user_id", fmt.Sprintf("counter is %d but user %d exists", s.UserId, maxUserId), func(s *DBStructure) {
+			s.UserId = maxUserId
+		})
+	}
+
+	emails := []string{}
+	for email := range owners {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	for _, email := range emails {
+		ids := owners[email]
+		record := "email " + email
+		if len(ids) > 1 {
+			report("email-duplicate", record, fmt.Sprintf("used by users %v", ids), nil)
+			continue
+		}
+		id, ok := s.Emails[email]
+		if !ok {
+			report("email-unindexed", record, fmt.Sprintf("user %d can't be found by email", ids[0]), func(s *DBStructure) {
+				s.Emails[email] = ids[0]
+			})
+		} else if id != ids[0] {
+			report("email-wrong-user", record, fmt.Sprintf("points at user %d instead of %d", id, ids[0]), func(s *DBStructure) {
+				s.Emails[email] = ids[0]
+			})
+		}
+	}
+	stale := []string{}
+	for email := range s.Emails {
+		if _, ok := owners[email]; !ok {
+			stale = append(stale, email)
+		}
+	}
+	sort.Strings(stale)
+	for _, email := range stale {
+		report("email-stale", "email "+email, fmt.Sprintf("points at user %d who doesn't have it", s.Emails[email]), func(s *DBStructure) {
+			delete(s.Emails, email)
+		})
+	}
+
+	tokens := []string{}
+	for token := range s.RefreshTokens {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	for _, token := range tokens {
+		userId := s.RefreshTokens[token].UserId
+		if _, ok := s.Users[userId]; !ok {
+			// don't put a live token in the report
+			report("token-user-missing", "token "+token[:min(len(token), 8)]+"...", fmt.Sprintf("user %d does not exist", userId), func(s *DBStructure) {
+				delete(s.RefreshTokens, token)
+			})
+		}
+	}
+
+	return violations
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := []int{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	return keys
+}
+
+// Check runs the integrity checks with every collection locked. With fix set
+// the fixable violations are repaired and a new snapshot is written; repairs
+// don't go through the journal since they aren't changes anyone asked for.
+func (db *DB) Check(fix bool) ([]Violation, error) {
+	release, err := db.lockFiles(true)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	unlock := db.lock(AllScopes, fix)
+	defer unlock()
+
+	violations := db.data.check()
+	if !fix {
+		return violations, nil
+	}
+
+	fixed := 0
+	for i := range violations {
+		if violations[i].fix == nil {
+			continue
+		}
+		violations[i].fix(&db.data)
+		violations[i].Fixed = true
+		fixed++
+	}
+	if fixed == 0 || db.journal == nil {
+		return violations, nil
+	}
+
+	db.journalMux.Lock()
+	defer db.journalMux.Unlock()
+	err = db.compact()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("fixed %d problems in %s", fixed, db.path)
+
+	return violations, nil
+}
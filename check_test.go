@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// brokenStore returns a store with one of each kind of problem check looks for
+func brokenStore(t *testing.T) *DB {
+	t.Helper()
+	store := NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+	err := store.Update(AllScopes, func(tx Tx) error {
+		for _, email := range []string{"ada@example.com", "alan@example.com"} {
+			_, err := tx.CreateUser(email, []byte("hash"))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateChirp(Chirp{Body: "first", AuthorId: 1})
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateChirp(Chirp{RechirpOf: 1, AuthorId: 2})
+		if err != nil {
+			return err
+		}
+		return tx.SaveRefreshToken("token-of-nobody", RefreshToken{UserId: 9})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &store.data
+	s.Chirps[3] = Chirp{Id: 3, AuthorId: 1, Version: 1, RechirpOf: 2}
+	s.Likes[1] = []int{2, 1, 2}
+	s.Scheduled[1] = Chirp{Id: 1, AuthorId: 9, Version: 1}
+	s.ScheduledId = 1
+	s.rebuildIndexes()
+
+	return store
+}
+
+func checksOf(violations []Violation) []string {
+	checks := []string{}
+	for _, v := range violations {
+		checks = append(checks, v.Check)
+	}
+	slices.Sort(checks)
+	return checks
+}
+
+func TestCheckFindsAndFixes(t *testing.T) {
+	store := brokenStore(t)
+
+	violations, err := store.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"chirp-counter-behind", "likes-unsorted", "rechirp-of-rechirp", "scheduled-author-missing", "token-user-missing"}
+	if got := checksOf(violations); !slices.Equal(got, want) {
+		t.Errorf("found %v, want %v", got, want)
+	}
+
+	_, err = store.Check(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	violations, err = store.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a human has to decide what the rechirp should point at
+	if got := checksOf(violations); !slices.Equal(got, []string{"rechirp-of-rechirp"}) {
+		t.Errorf("left after fixing: %v, want only rechirp-of-rechirp", got)
+	}
+	if likers := store.data.Likes[1]; !slices.Equal(likers, []int{1, 2}) {
+		t.Errorf("likes of chirp 1 = %v, want [1 2]", likers)
+	}
+	store.View(ChirpsScope, func(tx Tx) error {
+		if liked := tx.LikedChirps(2); len(liked) != 1 || liked[0].Id != 1 {
+			t.Errorf("chirps liked by user 2 = %v, want chirp 1", liked)
+		}
+		return nil
+	})
+}
+
+func TestRestoreRejectsBrokenInvariants(t *testing.T) {
+	backup, err := json.Marshal(brokenStore(t).data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decodeBackup(backup)
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("got %v, want %v", err, ErrInvalidSnapshot)
+	}
+}
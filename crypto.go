@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encrypted snapshots and journal lines start with this, plaintext ones with "{"
+const encryptedPrefix = "enc:"
+
+var (
+	errWrongKey  = errors.New("db file is encrypted with a key that isn't configured")
+	errNoKey     = errors.New("no DB_ENCRYPTION_KEY is configured")
+	errPlaintext = errors.New("db file isn't encrypted but DB_ENCRYPTION_KEY is set")
+)
+
+// dbCipher seals everything DB writes with the primary key and opens anything
+// sealed with the primary or one of the old keys, so keys can be rotated. A
+// nil *dbCipher means the db isn't encrypted.
+type dbCipher struct {
+	primaryId string
+	keys      map[string]cipher.AEAD
+}
+
+// keyId lets the reader pick the right key without trying them all
+func keyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return string(sum[:8])
+}
+
+func newDBCipher(key []byte, oldKeys [][]byte) (*dbCipher, error) {
+	if key == nil {
+		if len(oldKeys) > 0 {
+			return nil, errors.New("old encryption keys given without a current one")
+		}
+		return nil, nil
+	}
+
+	c := dbCipher{
+		primaryId: keyId(key),
+		keys:      map[string]cipher.AEAD{},
+	}
+	for _, k := range append([][]byte{key}, oldKeys...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.keys[keyId(k)] = aead
+	}
+
+	return &c, nil
+}
+
+// encryptionKeysFromEnv reads DB_ENCRYPTION_KEY and the comma separated
+// DB_ENCRYPTION_OLD_KEYS, all base64 encoded 32 byte keys.
+func encryptionKeysFromEnv() ([]byte, [][]byte, error) {
+	encoded := os.Getenv("DB_ENCRYPTION_KEY")
+	if encoded == "" {
+		return nil, nil, nil
+	}
+	key, err := decodeKey(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DB_ENCRYPTION_KEY: %w", err)
+	}
+
+	oldKeys := [][]byte{}
+	for _, encoded := range strings.Split(os.Getenv("DB_ENCRYPTION_OLD_KEYS"), ",") {
+		if strings.TrimSpace(encoded) == "" {
+			continue
+		}
+		oldKey, err := decodeKey(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, nil, fmt.Errorf("DB_ENCRYPTION_OLD_KEYS: %w", err)
+		}
+		oldKeys = append(oldKeys, oldKey)
+	}
+
+	return key, oldKeys, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+
+	return key, nil
+}
+
+// seal returns "enc:" + base64(key id | nonce | ciphertext), or plain as is
+// when there is no key
+func (c *dbCipher) seal(plain []byte) []byte {
+	if c == nil {
+		return plain
+	}
+
+	aead := c.keys[c.primaryId]
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+
+	payload := []byte(c.primaryId)
+	payload = append(payload, nonce...)
+	payload = aead.Seal(payload, nonce, plain, nil)
+
+	return []byte(encryptedPrefix + base64.StdEncoding.EncodeToString(payload))
+}
+
+// open reverses seal. It also reports whether the data was sealed with
+// anything but the primary key (or not at all), meaning it should be
+// rewritten. Encrypted data that no configured key can open is errWrongKey.
+// With a key, plaintext is errPlaintext unless allowPlain: whoever can write
+// the files could otherwise slip in records that were never authenticated.
+func (c *dbCipher) open(data []byte, allowPlain bool) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, []byte(encryptedPrefix)) {
+		if c != nil && !allowPlain {
+			return nil, false, errPlaintext
+		}
+		return data, c != nil, nil
+	}
+	if c == nil {
+		return nil, false, errWrongKey
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(string(bytes.TrimPrefix(data, []byte(encryptedPrefix))))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(payload) < 8 {
+		return nil, false, errors.New("encrypted data is too short")
+	}
+	id := string(payload[:8])
+	aead, ok := c.keys[id]
+	if !ok {
+		return nil, false, errWrongKey
+	}
+	payload = payload[8:]
+	if len(payload) < aead.NonceSize() {
+		return nil, false, errors.New("encrypted data is too short")
+	}
+
+	plain, err := aead.Open(nil, payload[:aead.NonceSize()], payload[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return plain, id != c.primaryId, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// newKeyedDB returns the path of a db holding one user, written with opts
+func newKeyedDB(t *testing.T, opts DBOptions) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(UsersScope, func(tx Tx) error {
+		_, err := tx.CreateUser("ada@example.com", []byte("hash"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func reopen(t *testing.T, path string, opts DBOptions) (*DB, error) {
+	t.Helper()
+	db, err := NewDB(path, opts)
+	if err == nil {
+		t.Cleanup(func() { db.Close() })
+	}
+	return db, err
+}
+
+func TestOpenRefusesWrongOrMissingKey(t *testing.T) {
+	path := newKeyedDB(t, DBOptions{EncryptionKey: testKey(1)})
+
+	for name, opts := range map[string]DBOptions{
+		"wrong key": {EncryptionKey: testKey(2)},
+		"no key":    {},
+	} {
+		_, err := reopen(t, path, opts)
+		if !errors.Is(err, errWrongKey) {
+			t.Errorf("%s: got %v, want %v", name, err, errWrongKey)
+		}
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	path := newKeyedDB(t, DBOptions{EncryptionKey: testKey(1)})
+
+	// the old key still opens the files, which are rewritten with the new one
+	db, err := reopen(t, path, DBOptions{EncryptionKey: testKey(2), OldEncryptionKeys: [][]byte{testKey(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = reopen(t, path, DBOptions{EncryptionKey: testKey(2)})
+	if err != nil {
+		t.Fatalf("the old key is still needed after rotating: %s", err)
+	}
+	if ids := userIds(t, db); !slices.Equal(ids, []int{1}) {
+		t.Errorf("users after rotating: %v, want [1]", ids)
+	}
+	newOnly, _ := newDBCipher(testKey(2), nil)
+	for _, file := range []string{path, generationPath(path, 1)} {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := newOnly.open(raw, false); err != nil {
+			t.Errorf("%s isn't sealed with the new key: %s", file, err)
+		}
+	}
+}
+
+func TestOpenRefusesPlaintextOnceEncrypted(t *testing.T) {
+	key := DBOptions{EncryptionKey: testKey(1)}
+
+	t.Run("journal entry", func(t *testing.T) {
+		path := newKeyedDB(t, key)
+		forged := `{"seq":99,"op":"token.issued","token":"forged","refreshToken":{"userId":1},"schema":5}` + "\n"
+		err := os.WriteFile(path+".log", []byte(forged), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = reopen(t, path, key)
+		if !errors.Is(err, errPlaintext) {
+			t.Errorf("got %v, want %v", err, errPlaintext)
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		path := newKeyedDB(t, key)
+		plain := newKeyedDB(t, DBOptions{})
+		data, err := os.ReadFile(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, data, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = reopen(t, path, key)
+		if !errors.Is(err, errPlaintext) {
+			t.Errorf("got %v, want %v", err, errPlaintext)
+		}
+	})
+}
+
+func TestEncryptPlaintextDB(t *testing.T) {
+	path := newKeyedDB(t, DBOptions{})
+	// one more plaintext generation to reseal
+	db, err := reopen(t, path, DBOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(UsersScope, func(tx Tx) error {
+		_, err := tx.CreateUser("alan@example.com", []byte("hash"))
+		return err
+	})
+	db.Close()
+
+	key := DBOptions{EncryptionKey: testKey(1)}
+	encrypt := key
+	encrypt.EncryptPlaintext = true
+	db, err = reopen(t, path, encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for _, file := range []string{path, path + ".log", generationPath(path, 1), generationPath(path, 2)} {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("example.com")) {
+			t.Errorf("%s still holds plaintext", file)
+		}
+	}
+	info, err := os.Stat(path + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("journal mode is %v, want 0600", info.Mode().Perm())
+	}
+
+	db, err = reopen(t, path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := userIds(t, db); !slices.Equal(ids, []int{1, 2}) {
+		t.Errorf("users after encrypting: %v, want [1 2]", ids)
+	}
+}
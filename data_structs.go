@@ -1,6 +1,9 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 type Server struct {
 	Addr    string
@@ -11,13 +14,20 @@ type apiConfig struct {
 	fileserverHits int
 	jwtSecret      string
 	polkaKey       string
+	adminKey       string
+	store          Store
+	maintenance    *maintenanceStats
 }
 
 type User struct {
 	Id          int    `json:"id"`
 	Email       string `json:"email"`
-	Password    []byte
-	IsChirpyRed bool `json:"is_chirpy_red"`
+	Password    []byte `json:",omitempty"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	// Version goes up by one with every change, it's the user's ETag
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
 }
 
 type RefreshToken struct {
@@ -25,8 +35,44 @@ type RefreshToken struct {
 	Expiration int64 `json:"expiration"`
 }
 
+// ChirpRevision is what a chirp said before an edit
+type ChirpRevision struct {
+	Version    int       `json:"version"`
+	Body       string    `json:"body"`
+	ReplacedAt time.Time `json:"replaced_at,omitzero"`
+}
+
 type Chirp struct {
 	Id       int    `json:"id"`
 	Body     string `json:"body"`
 	AuthorId int    `json:"author_id"`
+	Version  int    `json:"version"`
+	// only edits to the body move UpdatedAt, likes and replies don't
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+	// only set while the chirp waits to be published
+	PublishAt time.Time `json:"publish_at,omitzero"`
+	// the chirp this one answers, 0 if it starts a conversation
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	// a rechirp shares another chirp as is and has no body, a quote adds a
+	// body to it. Both always point at an original, never at a rechirp.
+	RechirpOf int `json:"rechirp_of,omitempty"`
+	QuoteOf   int `json:"quote_of,omitempty"`
+	// taken from the body whenever it's written. Mentions are user ids, so
+	// they keep pointing at the right people when emails change.
+	Hashtags []string `json:"hashtags,omitempty"`
+	Mentions []int    `json:"mentions,omitempty"`
+	// counts and the original are filled in from the indexes when a chirp is
+	// read. Original is left out once the quoted chirp is deleted.
+	ReplyCount   int    `json:"reply_count"`
+	LikeCount    int    `json:"like_count"`
+	RechirpCount int    `json:"rechirp_count"`
+	QuoteCount   int    `json:"quote_count"`
+	Original     *Chirp `json:"original,omitempty"`
+}
+
+// Like is what change events say about likes
+type Like struct {
+	ChirpId int `json:"chirp_id"`
+	UserId  int `json:"user_id"`
 }
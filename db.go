@@ -1,18 +1,71 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
 	"errors"
 	"io/fs"
 	"log"
 	"os"
-	"sort"
 	"sync"
+	"time"
 )
 
+// compact the journal into a fresh snapshot after this many entries
+const snapshotEvery = 1000
+
+// DB keeps the whole DBStructure in memory and serves every read from it. When
+// it has a path, every change is appended to a journal next to the snapshot
+// file and the journal is folded back into the snapshot once it grows past
+// snapshotEvery entries.
+//
+// Each collection has its own lock so transactions on different collections
+// run side by side. journalMux covers everything shared between them: Seq, the
+// journal file and the bookkeeping around it.
+//
+// A shared DB additionally holds an OS file lock for every transaction, and
+// first pulls in whatever other processes wrote since it last looked. Views
+// and backups share it, everything that writes holds it alone.
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path          string
+	locks         []*sync.RWMutex
+	journalMux    *sync.Mutex
+	data          DBStructure
+	journal       *os.File
+	cipher        *dbCipher
+	journalOffset int64
+	snapshotInfo  os.FileInfo
+	logEntries    int
+	opts          DBOptions
+	pending       bytes.Buffer
+	stop          chan struct{}
+	stopped       chan struct{}
+	// flock belongs to the open file, not the goroutine, so fileMux keeps
+	// writers in this process from sharing it. Readers do share it; the
+	// first one takes the shared flock and the last one drops it.
+	lockFile  *os.File
+	fileMux   *sync.RWMutex
+	readerMux *sync.Mutex
+	readers   int
+	events    *eventHub
+}
+
+type DBOptions struct {
+	// FlushInterval batches journal writes. Zero writes and syncs every change
+	// before the request returns; anything else keeps changes in memory for up
+	// to that long, so a crash can lose them.
+	FlushInterval time.Duration
+	// Shared lets several processes use the same files. Writes are never
+	// batched in this mode, since other processes couldn't see them.
+	Shared bool
+	// EncryptionKey turns on AES-GCM encryption of everything written to
+	// disk. Files sealed with one of OldEncryptionKeys are still readable and
+	// get rewritten with EncryptionKey on load.
+	EncryptionKey     []byte
+	OldEncryptionKeys [][]byte
+	// EncryptPlaintext lets NewDB read a db that isn't encrypted yet, to seal
+	// it with EncryptionKey. Otherwise plaintext files are refused once there
+	// is a key.
+	EncryptPlaintext bool
 }
 
 type DBStructure struct {
@@ -22,21 +75,241 @@ type DBStructure struct {
 	ChirpId       int                     `json:"chirpId"`
 	UserId        int                     `json:"userId"`
 	RefreshTokens map[string]RefreshToken `json:"refreshTokens"`
+	// earlier revisions of edited chirps, oldest first
+	ChirpHistory map[int][]ChirpRevision `json:"chirpHistory"`
+	// chirp id -> ids of the users who liked it, ascending
+	Likes map[int][]int `json:"likes"`
+	// scheduled id -> chirps waiting for their publish_at. They aren't in
+	// Chirps or any index, and only get a chirp id when they are published,
+	// so feeds paging by id see them in the order they went out.
+	Scheduled     map[int]Chirp `json:"scheduled"`
+	ScheduledId   int           `json:"scheduledId"`
+	Seq           uint64        `json:"seq"`
+	SchemaVersion int           `json:"schema_version"`
+	// the schema of journal entries that don't carry one. Those were written
+	// before entries were stamped, by the build that wrote the snapshot on
+	// disk. Covered by journalMux.
+	journalSchema int
+	idx           indexes
 }
 
-func NewDB(path string) (*DB, error) {
+func NewDB(path string, opts DBOptions) (*DB, error) {
 	db := DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:       path,
+		locks:      newCollectionLocks(),
+		journalMux: &sync.Mutex{},
+		opts:       opts,
+		events:     newEventHub(),
 	}
 	err := db.ensureDB()
 	if err != nil {
 		log.Fatal("DB load failed")
 	}
+	db.cipher, err = newDBCipher(opts.EncryptionKey, opts.OldEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	db.journal, err = openJournal(db.journalPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Shared {
+		if opts.FlushInterval > 0 {
+			log.Printf("ignoring flush interval, a shared db writes every change immediately")
+			db.opts.FlushInterval = 0
+		}
+		db.lockFile, err = os.OpenFile(db.path+".lock", os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return nil, err
+		}
+		db.fileMux = &sync.RWMutex{}
+		db.readerMux = &sync.Mutex{}
+		err = flock(db.lockFile)
+		if err != nil {
+			return nil, err
+		}
+		defer funlock(db.lockFile)
+	}
+
+	err = db.load()
+	if err != nil {
+		return nil, err
+	}
+	err = resealOldFiles(db.path, db.cipher)
+	if err != nil {
+		return nil, err
+	}
+	// everything is sealed now, later reloads must not accept plaintext
+	db.opts.EncryptPlaintext = false
+
+	if db.opts.FlushInterval > 0 {
+		db.stop = make(chan struct{})
+		db.stopped = make(chan struct{})
+		go db.flushLoop()
+	}
 
 	return &db, nil
 }
 
+// NewMemoryStore returns a DB that never touches the disk. Everything is lost
+// when the process exits, which makes it handy for demos.
+func NewMemoryStore() *DB {
+	return &DB{
+		locks:      newCollectionLocks(),
+		journalMux: &sync.Mutex{},
+		data:       newDBStructure(),
+		events:     newEventHub(),
+	}
+}
+
+// load replaces the in-memory state with the newest snapshot plus the whole
+// journal. Callers hold every collection lock and journalMux, or are NewDB.
+func (db *DB) load() error {
+	data, stale, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	applied, end, err := replayJournal(db.journal, &data, 0, db.cipher, db.opts.EncryptPlaintext)
+	if err != nil {
+		return err
+	}
+	db.data = data
+	db.logEntries = applied
+	db.journalOffset = end
+
+	if applied > 0 {
+		log.Printf("replayed %d journal entries", applied)
+	}
+	if applied > 0 || stale {
+		return db.compact()
+	}
+	db.snapshotInfo, err = os.Stat(db.path)
+
+	return err
+}
+
+// lockFiles takes the cross-process lock of a shared DB and catches up with
+// other processes. The returned func releases it. Unshared DBs get a no-op.
+//
+// Without exclusive the lock is shared with other readers, here and in other
+// processes. Those can still replay the journal, but reloading a snapshot
+// another process compacted may write one, so for that a reader takes the
+// exclusive lock instead.
+func (db *DB) lockFiles(exclusive bool) (func(), error) {
+	if db.lockFile == nil {
+		return func() {}, nil
+	}
+
+	if !exclusive {
+		release, err := db.lockFilesShared()
+		if err != nil {
+			return nil, err
+		}
+		err = db.catchUp(false)
+		if err == nil {
+			return release, nil
+		}
+		release()
+		if !errors.Is(err, errReloadNeeded) {
+			return nil, err
+		}
+	}
+
+	db.fileMux.Lock()
+	err := flock(db.lockFile)
+	if err != nil {
+		db.fileMux.Unlock()
+		return nil, err
+	}
+	release := func() {
+		funlock(db.lockFile)
+		db.fileMux.Unlock()
+	}
+
+	err = db.catchUp(true)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	return release, nil
+}
+
+func (db *DB) lockFilesShared() (func(), error) {
+	db.fileMux.RLock()
+	db.readerMux.Lock()
+	defer db.readerMux.Unlock()
+	if db.readers == 0 {
+		err := flockShared(db.lockFile)
+		if err != nil {
+			db.fileMux.RUnlock()
+			return nil, err
+		}
+	}
+	db.readers++
+
+	return func() {
+		db.readerMux.Lock()
+		db.readers--
+		if db.readers == 0 {
+			funlock(db.lockFile)
+		}
+		db.readerMux.Unlock()
+		db.fileMux.RUnlock()
+	}, nil
+}
+
+var errReloadNeeded = errors.New("the snapshot was replaced, reloading needs the exclusive lock")
+
+// catchUp pulls in whatever other processes wrote since this one last read or
+// wrote the files: new journal entries are replayed, and a new snapshot (some
+// other process compacted) means reloading from scratch, which only happens
+// with the file lock held exclusively. Callers hold the file lock.
+func (db *DB) catchUp(exclusive bool) error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	journalInfo, err := db.journal.Stat()
+	if err != nil {
+		return err
+	}
+	// readers sharing the lock may be catching up too
+	db.journalMux.Lock()
+	sameSnapshot := os.SameFile(info, db.snapshotInfo) && info.ModTime().Equal(db.snapshotInfo.ModTime())
+	upToDate := sameSnapshot && journalInfo.Size() == db.journalOffset
+	appended := sameSnapshot && journalInfo.Size() > db.journalOffset
+	db.journalMux.Unlock()
+	if upToDate {
+		return nil
+	}
+	if !appended && !exclusive {
+		return errReloadNeeded
+	}
+
+	unlock := db.lock(AllScopes, true)
+	defer unlock()
+	db.journalMux.Lock()
+	defer db.journalMux.Unlock()
+
+	if appended {
+		// nothing left if another reader got here first
+		applied, end, err := replayJournal(db.journal, &db.data, db.journalOffset, db.cipher, false)
+		db.logEntries += applied
+		db.journalOffset = end
+		return err
+	}
+
+	log.Printf("%s was replaced by another process, reloading", db.path)
+	return db.load()
+}
+
+func (db *DB) journalPath() string {
+	return db.path + ".log"
+}
+
 func (db *DB) ensureDB() error {
 	_, err := os.ReadFile(db.path)
 	if errors.Is(err, fs.ErrNotExist) {
@@ -51,65 +324,269 @@ func (db *DB) ensureDB() error {
 	return nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-	data, err := os.ReadFile(db.path)
+func (db *DB) loadDB() (DBStructure, bool, error) {
+	dbData, stale, err := loadNewestSnapshot(db.path, db.cipher, db.opts.EncryptPlaintext)
+	if err != nil {
+		log.Printf("Error decoding db file: %s", err)
+		return DBStructure{}, false, err
+	}
+
+	return dbData, stale, nil
+}
+
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	err := writeSnapshot(db.path, dbStructure, db.cipher)
+	if err != nil {
+		log.Printf("Error writing file: %s", err)
+		return err
+	}
+	return nil
+}
+
+func newCollectionLocks() []*sync.RWMutex {
+	locks := []*sync.RWMutex{}
+	for scope := Scope(1); scope <= AllScopes; scope <<= 1 {
+		locks = append(locks, &sync.RWMutex{})
+	}
+
+	return locks
+}
+
+// lock takes the locks for scope, always in the same order so two
+// transactions can't deadlock, and returns the matching unlock.
+func (db *DB) lock(scope Scope, write bool) func() {
+	unlocks := []func(){}
+	for i, mux := range db.locks {
+		switch {
+		case scope&(1<<i) != 0 && write:
+			mux.Lock()
+			unlocks = append(unlocks, mux.Unlock)
+		case scope&(1<<i) != 0, scope&(1<<(i+readOnlyShift)) != 0:
+			mux.RLock()
+			unlocks = append(unlocks, mux.RUnlock)
+		}
+	}
+
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// compact writes the in-memory state as the new snapshot and empties the
+// journal. The snapshot records the last sequence number it contains, so a
+// crash between the two steps only means some entries get skipped on replay.
+// Callers hold every collection lock and journalMux.
+func (db *DB) compact() error {
+	err := db.writeDB(db.data)
+	if err != nil {
+		return err
+	}
+	// anything still waiting to be flushed is part of the snapshot now
+	db.pending.Reset()
+	err = db.journal.Truncate(0)
 	if err != nil {
-		return DBStructure{}, err
+		return err
+	}
+	db.logEntries = 0
+	db.journalOffset = 0
+	db.data.journalSchema = currentSchemaVersion
+	db.snapshotInfo, err = os.Stat(db.path)
+
+	return err
+}
+
+// compactIfDue folds the journal into a snapshot once it is long enough. It
+// needs a consistent view of every collection, so it must not be called while
+// holding any collection lock.
+func (db *DB) compactIfDue() {
+	if db.journal == nil {
+		return
 	}
-	if len(data) == 0 {
-		return DBStructure{
-			Chirps:        map[int]Chirp{},
-			Users:         map[int]User{},
-			Emails:        map[string]int{},
-			ChirpId:       0,
-			UserId:        0,
-			RefreshTokens: map[string]RefreshToken{},
-		}, nil
+	unlock := db.lock(AllScopes, false)
+	defer unlock()
+	db.journalMux.Lock()
+	defer db.journalMux.Unlock()
+
+	if db.logEntries < snapshotEvery {
+		// someone else got here first
+		return
 	}
-	dbData := DBStructure{}
-	err = json.Unmarshal(data, &dbData)
+	// the entries are already in the journal, a failed compaction can wait
+	err := db.compact()
 	if err != nil {
-		log.Printf("Error decoding db file: %s", err)
-		return DBStructure{}, err
+		log.Printf("failed to compact journal: %s", err)
+	}
+}
+
+// commit numbers and persists the entries of a transaction that has already
+// been applied to memory. Without a flush interval they are on disk before the
+// caller sees success; if that fails memory is rolled back so it never holds
+// anything the disk doesn't. It reports whether the journal is due for
+// compaction.
+func (db *DB) commit(tx *dbTx) (bool, error) {
+	if len(tx.entries) == 0 {
+		return false, nil
+	}
+	db.journalMux.Lock()
+	defer db.journalMux.Unlock()
+
+	seq := db.data.Seq
+	encoded := []byte{}
+	for i := range tx.entries {
+		seq++
+		tx.entries[i].Seq = seq
+		if db.journal == nil {
+			continue
+		}
+		data, err := encodeEntry(tx.entries[i], db.cipher)
+		if err != nil {
+			tx.rollback()
+			return false, err
+		}
+		encoded = append(encoded, data...)
+	}
+
+	if db.journal != nil {
+		if db.opts.FlushInterval > 0 {
+			db.pending.Write(encoded)
+		} else {
+			end, err := writeJournal(db.journal, encoded)
+			if err != nil {
+				log.Printf("Error writing journal: %s", err)
+				tx.rollback()
+				return false, err
+			}
+			db.journalOffset = end
+		}
+		db.logEntries += len(tx.entries)
 	}
+	db.data.Seq = seq
+	// still under journalMux, so subscribers see events in seq order
+	db.events.publish(eventsOf(tx))
 
-	return dbData, nil
+	return db.logEntries >= snapshotEvery, nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	data, err := json.Marshal(dbStructure)
+// View runs fn with read locks on the collections in scope
+func (db *DB) View(scope Scope, fn func(tx Tx) error) error {
+	release, err := db.lockFiles(false)
 	if err != nil {
-		log.Printf("Error marshalling: %s", err)
 		return err
 	}
+	defer release()
+
+	unlock := db.lock(scope, false)
+	defer unlock()
 
-	err = os.WriteFile(db.path, data, 0666)
+	return fn(newTx(&db.data, scope, false))
+}
+
+// Update runs fn with write locks on the collections in scope
+func (db *DB) Update(scope Scope, fn func(tx Tx) error) error {
+	release, err := db.lockFiles(true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	unlock := db.lock(scope, true)
+	tx := newTx(&db.data, scope, true)
+	returned := false
+	defer func() {
+		// fn panicked, e.g. by leaving its scope. Undo what it did and let
+		// the panic go on without the collections locked.
+		if !returned {
+			tx.rollback()
+			unlock()
+		}
+	}()
+	err = fn(tx)
+	returned = true
+	if err != nil {
+		tx.rollback()
+		unlock()
+		return err
+	}
+	compact, err := db.commit(tx)
+	unlock()
+
+	if compact {
+		db.compactIfDue()
+	}
+
+	return err
+}
+
+// flush writes out batched journal entries. Callers hold journalMux.
+func (db *DB) flush() error {
+	if db.pending.Len() == 0 {
+		return nil
+	}
+	end, err := writeJournal(db.journal, db.pending.Bytes())
 	if err != nil {
-		log.Printf("Error writing file: %s", err)
 		return err
 	}
+	db.journalOffset = end
+	db.pending.Reset()
+
 	return nil
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+func (db *DB) flushLoop() {
+	defer close(db.stopped)
+	ticker := time.NewTicker(db.opts.FlushInterval)
+	defer ticker.Stop()
 
-	chirps, err := db.loadDB()
-	if err != nil {
-		log.Printf("failed to get chirps: %s", err)
-		return []Chirp{}, err
+	for {
+		select {
+		case <-ticker.C:
+			db.journalMux.Lock()
+			err := db.flush()
+			db.journalMux.Unlock()
+			if err != nil {
+				// keep the batch and try again on the next tick
+				log.Printf("failed to flush journal: %s", err)
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// Close flushes everything, writes a final snapshot and releases the files.
+// The DB must not be used afterwards.
+func (db *DB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.stopped
 	}
-	keys := []int{}
-	for k := range chirps.Chirps {
-		keys = append(keys, k)
+	if db.journal == nil {
+		return nil
 	}
-	sort.Ints(keys)
 
-	chirpsSlice := []Chirp{}
-	for _, k := range keys {
-		chirpsSlice = append(chirpsSlice, chirps.Chirps[k])
+	release, err := db.lockFiles(true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	unlock := db.lock(AllScopes, true)
+	defer unlock()
+	db.journalMux.Lock()
+	defer db.journalMux.Unlock()
+
+	err = db.flush()
+	if err != nil {
+		log.Printf("failed to flush journal: %s", err)
+	}
+	if db.logEntries > 0 {
+		err = db.compact()
+		if err != nil {
+			return err
+		}
 	}
 
-	return chirpsSlice, nil
+	return db.journal.Close()
 }
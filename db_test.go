@@ -0,0 +1,78 @@
+//go:build unix
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openShared(t *testing.T, path string) *DB {
+	t.Helper()
+	db, err := NewDB(path, DBOptions{Shared: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Two processes sharing the files are played by two DBs on the same path:
+// flock treats separately opened files like separate processes.
+func TestSharedViewsDontBlockEachOther(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	a := openShared(t, path)
+	b := openShared(t, path)
+
+	err := a.Update(UsersScope, func(tx Tx) error {
+		_, err := tx.CreateUser("ada@example.com", []byte("hash"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	viewed := make(chan struct{})
+	go func() {
+		defer close(viewed)
+		a.View(UsersScope, func(tx Tx) error {
+			close(inside)
+			<-release
+			return nil
+		})
+	}()
+	waitFor(t, inside, "the first view")
+
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		err := b.View(UsersScope, func(tx Tx) error {
+			_, err := tx.UserByEmail("ada@example.com")
+			return err
+		})
+		if err != nil {
+			t.Errorf("the other process doesn't see ada: %s", err)
+		}
+	}()
+	waitFor(t, read, "a view in the other process")
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		b.Update(UsersScope, func(tx Tx) error {
+			_, err := tx.CreateUser("alan@example.com", []byte("hash"))
+			return err
+		})
+	}()
+	select {
+	case <-written:
+		t.Fatal("the other process wrote while a view was open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	waitFor(t, viewed, "the first view")
+	waitFor(t, written, "the write in the other process")
+}
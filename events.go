@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// keep this many events around for subscribers resuming after a disconnect
+const eventBacklog = 1000
+
+var ErrEventsGone = errors.New("events are no longer available")
+
+// LatestEvent subscribes to new events only
+const LatestEvent = ^uint64(0)
+
+// Event describes one committed change. Seq is the journal sequence number of
+// the change, so events are strictly ordered and a consumer can resume from
+// the last one it saw. Before is empty for creations, After for deletions.
+// Password hashes and full refresh tokens are left out.
+type Event struct {
+	Seq    uint64      `json:"seq"`
+	Entity string      `json:"entity"`
+	Op     string      `json:"op"`
+	Id     string      `json:"id"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// eventsOf turns the entries of a committed transaction into events. undo
+// lines up with entries and holds whatever each entry replaced.
+func eventsOf(tx *dbTx) []Event {
+	events := []Event{}
+	for i, entry := range tx.entries {
+		inverse := tx.undo[i]
+		entity, op, _ := strings.Cut(entry.Op, ".")
+		event := Event{Seq: entry.Seq, Entity: entity, Op: op}
+		switch entry.Op {
+		case opChirpCreated:
+			event.Id = strconv.Itoa(entry.Chirp.Id)
+			event.After = *entry.Chirp
+		case opChirpUpdated:
+			event.Id = strconv.Itoa(entry.Chirp.Id)
+			event.Before = *inverse.Chirp
+			event.After = *entry.Chirp
+		case opChirpDeleted:
+			event.Id = strconv.Itoa(entry.Id)
+			event.Before = *inverse.Chirp
+		case opChirpScheduled:
+			event.Id = strconv.Itoa(entry.Chirp.Id)
+			event.After = *entry.Chirp
+			if inverse.Chirp != nil {
+				event.Before = *inverse.Chirp
+			}
+		case opChirpUnscheduled:
+			event.Id = strconv.Itoa(entry.Id)
+			event.Before = *inverse.Chirp
+		case opUserCreated, opUserUpdated, opUserDeleted:
+			if entry.User != nil {
+				event.Id = strconv.Itoa(entry.User.Id)
+				event.After = redactUser(*entry.User)
+			} else {
+				event.Id = strconv.Itoa(entry.Id)
+			}
+			if inverse.User != nil {
+				event.Before = redactUser(*inverse.User)
+			}
+		case opLikeAdded:
+			event.Id = strconv.Itoa(entry.Id)
+			event.After = Like{ChirpId: entry.Id, UserId: entry.UserId}
+		case opLikeRemoved:
+			event.Id = strconv.Itoa(entry.Id)
+			event.Before = Like{ChirpId: entry.Id, UserId: entry.UserId}
+		case opTokenIssued, opTokenRevoked:
+			event.Id = entry.Token[:min(len(entry.Token), 8)]
+			if entry.RefreshToken != nil {
+				event.After = *entry.RefreshToken
+			}
+			if inverse.RefreshToken != nil {
+				event.Before = *inverse.RefreshToken
+			}
+		}
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func redactUser(user User) User {
+	user.Password = nil
+	return user
+}
+
+// eventHub hands committed events to in-process subscribers. publish never
+// blocks: a subscriber that falls too far behind is dropped and has to
+// resume from the last event it got.
+type eventHub struct {
+	mux         sync.Mutex
+	recent      []Event
+	subscribers map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	// Backlog holds the events after the requested seq that happened before
+	// subscribing, C everything after that. C is closed when the subscription
+	// is dropped.
+	Backlog []Event
+	C       <-chan Event
+	c       chan Event
+	hub     *eventHub
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+func (hub *eventHub) publish(events []Event) {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+
+	hub.recent = append(hub.recent, events...)
+	if len(hub.recent) > eventBacklog {
+		hub.recent = append([]Event{}, hub.recent[len(hub.recent)-eventBacklog:]...)
+	}
+	for sub := range hub.subscribers {
+		for _, event := range events {
+			select {
+			case sub.c <- event:
+				continue
+			default:
+			}
+			hub.drop(sub)
+			break
+		}
+	}
+}
+
+// subscribe returns everything after seq that is still around, and every
+// event from then on. A seq that has already fallen out of the backlog is
+// ErrEventsGone: the consumer missed events and has to resync. Callers hold
+// journalMux so currentSeq can't move.
+func (hub *eventHub) subscribe(seq uint64, currentSeq uint64) (*Subscription, error) {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+
+	if seq == LatestEvent {
+		seq = currentSeq
+	}
+	if seq > currentSeq {
+		return nil, ErrEventsGone
+	}
+	backlog := []Event{}
+	if seq < currentSeq {
+		if len(hub.recent) == 0 || hub.recent[0].Seq > seq+1 {
+			return nil, ErrEventsGone
+		}
+		for _, event := range hub.recent {
+			if event.Seq > seq {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	c := make(chan Event, 256)
+	sub := &Subscription{Backlog: backlog, C: c, c: c, hub: hub}
+	hub.subscribers[sub] = struct{}{}
+
+	return sub, nil
+}
+
+// drop closes a subscription. Callers hold mux.
+func (hub *eventHub) drop(sub *Subscription) {
+	if _, ok := hub.subscribers[sub]; !ok {
+		return
+	}
+	delete(hub.subscribers, sub)
+	close(sub.c)
+}
+
+// reset forgets every event and drops every subscriber, for when the data
+// was replaced wholesale and the events no longer describe how it got there
+func (hub *eventHub) reset() {
+	hub.mux.Lock()
+	defer hub.mux.Unlock()
+
+	hub.recent = nil
+	for sub := range hub.subscribers {
+		hub.drop(sub)
+	}
+}
+
+func (sub *Subscription) Close() {
+	sub.hub.mux.Lock()
+	defer sub.hub.mux.Unlock()
+
+	sub.hub.drop(sub)
+}
+
+// Subscribe streams the events committed after seq, or only new ones for
+// LatestEvent. Events are published in commit order while the journal is
+// locked, so none are missed or repeated between the backlog and C. Changes
+// made by other processes sharing the files aren't seen.
+func (db *DB) Subscribe(seq uint64) (*Subscription, error) {
+	db.journalMux.Lock()
+	defer db.journalMux.Unlock()
+
+	return db.events.subscribe(seq, db.data.Seq)
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoFileLocking = errors.New("sharing the db between processes isn't supported on this platform")
+
+func flock(f *os.File) error {
+	return errNoFileLocking
+}
+
+func flockShared(f *os.File) error {
+	return errNoFileLocking
+}
+
+func funlock(f *os.File) error {
+	return errNoFileLocking
+}
@@ -1,10 +1,9 @@
 module github.com/kevinarchambeau/goWebServer
 
-go 1.22.3
-
-require golang.org/x/crypto v0.26.0
+go 1.24
 
 require (
-	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.26.0
 )
@@ -0,0 +1,150 @@
+package main
+
+import "slices"
+
+// indexes are derived from the records, kept up to date by apply and rebuilt
+// whenever a snapshot is loaded. They are never persisted.
+type indexes struct {
+	// every chirp id, ascending
+	chirps []int
+	// author id -> that author's chirp ids, ascending
+	chirpsByAuthor map[int][]int
+	// word -> ids of the chirps containing it, ascending
+	terms map[string][]int
+	// chirp id -> ids of its replies, ascending. Replies to a deleted chirp
+	// stay under its id.
+	replies map[int][]int
+	// user id -> ids of the chirps they liked, ascending
+	likesByUser map[int][]int
+	// chirp id -> ids of the rechirps and quotes of it, ascending
+	rechirps map[int][]int
+	quotes   map[int][]int
+	// hashtag -> ids of the chirps tagged with it, ascending
+	hashtags map[string][]int
+	// user id -> ids of the chirps mentioning them, ascending
+	mentions map[int][]int
+	// handle -> ids of the users whose email starts with it, ascending. Part
+	// of the users collection, the others belong to chirps.
+	handles map[string][]int
+}
+
+func newIndexes() indexes {
+	return indexes{
+		chirpsByAuthor: map[int][]int{},
+		terms:          map[string][]int{},
+		replies:        map[int][]int{},
+		likesByUser:    map[int][]int{},
+		rechirps:       map[int][]int{},
+		quotes:         map[int][]int{},
+		hashtags:       map[string][]int{},
+		mentions:       map[int][]int{},
+		handles:        map[string][]int{},
+	}
+}
+
+func (s *DBStructure) rebuildIndexes() {
+	s.idx = newIndexes()
+	for _, chirp := range s.Chirps {
+		s.indexChirp(chirp)
+	}
+	for chirpId, userIds := range s.Likes {
+		for _, userId := range userIds {
+			s.idx.likesByUser[userId] = insertSorted(s.idx.likesByUser[userId], chirpId)
+		}
+	}
+	for _, user := range s.Users {
+		handle := handleOf(user.Email)
+		s.idx.handles[handle] = insertSorted(s.idx.handles[handle], user.Id)
+	}
+}
+
+// setLikes replaces everyone who liked a chirp
+func (s *DBStructure) setLikes(chirpId int, userIds []int) {
+	for _, userId := range s.Likes[chirpId] {
+		removeFromIndex(s.idx.likesByUser, userId, chirpId)
+	}
+	if len(userIds) == 0 {
+		delete(s.Likes, chirpId)
+		return
+	}
+	s.Likes[chirpId] = userIds
+	for _, userId := range userIds {
+		s.idx.likesByUser[userId] = insertSorted(s.idx.likesByUser[userId], chirpId)
+	}
+}
+
+func (s *DBStructure) indexChirp(chirp Chirp) {
+	s.idx.chirps = insertSorted(s.idx.chirps, chirp.Id)
+	s.idx.chirpsByAuthor[chirp.AuthorId] = insertSorted(s.idx.chirpsByAuthor[chirp.AuthorId], chirp.Id)
+	for _, term := range tokenize(chirp.Body) {
+		s.idx.terms[term] = insertSorted(s.idx.terms[term], chirp.Id)
+	}
+	if chirp.InReplyTo != 0 {
+		s.idx.replies[chirp.InReplyTo] = insertSorted(s.idx.replies[chirp.InReplyTo], chirp.Id)
+	}
+	if chirp.RechirpOf != 0 {
+		s.idx.rechirps[chirp.RechirpOf] = insertSorted(s.idx.rechirps[chirp.RechirpOf], chirp.Id)
+	}
+	if chirp.QuoteOf != 0 {
+		s.idx.quotes[chirp.QuoteOf] = insertSorted(s.idx.quotes[chirp.QuoteOf], chirp.Id)
+	}
+	for _, tag := range chirp.Hashtags {
+		s.idx.hashtags[tag] = insertSorted(s.idx.hashtags[tag], chirp.Id)
+	}
+	for _, userId := range chirp.Mentions {
+		s.idx.mentions[userId] = insertSorted(s.idx.mentions[userId], chirp.Id)
+	}
+}
+
+func (s *DBStructure) unindexChirp(chirp Chirp) {
+	s.idx.chirps = removeSorted(s.idx.chirps, chirp.Id)
+	removeFromIndex(s.idx.chirpsByAuthor, chirp.AuthorId, chirp.Id)
+	for _, term := range tokenize(chirp.Body) {
+		removeFromIndex(s.idx.terms, term, chirp.Id)
+	}
+	if chirp.InReplyTo != 0 {
+		removeFromIndex(s.idx.replies, chirp.InReplyTo, chirp.Id)
+	}
+	if chirp.RechirpOf != 0 {
+		removeFromIndex(s.idx.rechirps, chirp.RechirpOf, chirp.Id)
+	}
+	if chirp.QuoteOf != 0 {
+		removeFromIndex(s.idx.quotes, chirp.QuoteOf, chirp.Id)
+	}
+	for _, tag := range chirp.Hashtags {
+		removeFromIndex(s.idx.hashtags, tag, chirp.Id)
+	}
+	for _, userId := range chirp.Mentions {
+		removeFromIndex(s.idx.mentions, userId, chirp.Id)
+	}
+}
+
+// removeFromIndex drops id from the ids under key, and the key once it has
+// no ids left
+func removeFromIndex[K comparable](index map[K][]int, key K, id int) {
+	ids := removeSorted(index[key], id)
+	if len(ids) == 0 {
+		delete(index, key)
+		return
+	}
+	index[key] = ids
+}
+
+// ids almost always arrive in order, so this is usually just an append
+func insertSorted(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if found {
+		return ids
+	}
+
+	return slices.Insert(ids, i, id)
+}
+
+func removeSorted(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if !found {
+		return ids
+	}
+
+	return slices.Delete(ids, i, i+1)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	opChirpCreated = "chirp.created"
+	opChirpUpdated = "chirp.updated"
+	opChirpDeleted = "chirp.deleted"
+	opUserCreated  = "user.created"
+	opUserUpdated  = "user.updated"
+	opUserDeleted  = "user.deleted"
+	opTokenIssued  = "token.issued"
+	opTokenRevoked = "token.revoked"
+	opLikeAdded    = "like.added"
+	opLikeRemoved  = "like.removed"
+
+	// a chirp was queued or rescheduled, and taken out of the queue to be
+	// published or cancelled
+	opChirpScheduled   = "chirp.scheduled"
+	opChirpUnscheduled = "chirp.unscheduled"
+)
+
+// journalEntry is one line of the append-only log. Only the fields the op
+// needs are set.
+type journalEntry struct {
+	Seq          uint64        `json:"seq"`
+	Op           string        `json:"op"`
+	Id           int           `json:"id,omitempty"`
+	Chirp        *Chirp        `json:"chirp,omitempty"`
+	User         *User         `json:"user,omitempty"`
+	Token        string        `json:"token,omitempty"`
+	RefreshToken *RefreshToken `json:"refreshToken,omitempty"`
+	UserId       int           `json:"userId,omitempty"`
+	// a chirp's earlier revisions and likes, only used to put them back on
+	// rollback
+	History []ChirpRevision `json:"history,omitempty"`
+	Likers  []int           `json:"likers,omitempty"`
+	Time    time.Time       `json:"time,omitzero"`
+	// the currentSchemaVersion of the build that wrote the entry
+	Schema int `json:"schema,omitempty"`
+}
+
+func (s *DBStructure) apply(entry journalEntry) error {
+	switch entry.Op {
+	case opChirpCreated:
+		if old, ok := s.Chirps[entry.Chirp.Id]; ok {
+			s.unindexChirp(old)
+		}
+		s.Chirps[entry.Chirp.Id] = *entry.Chirp
+		s.indexChirp(*entry.Chirp)
+		s.ChirpId = max(s.ChirpId, entry.Chirp.Id)
+		if len(entry.History) > 0 {
+			s.ChirpHistory[entry.Chirp.Id] = entry.History
+		} else {
+			delete(s.ChirpHistory, entry.Chirp.Id)
+		}
+		s.setLikes(entry.Chirp.Id, entry.Likers)
+	case opChirpUpdated:
+		old := s.Chirps[entry.Chirp.Id]
+		s.unindexChirp(old)
+		s.ChirpHistory[old.Id] = append(s.ChirpHistory[old.Id], ChirpRevision{
+			Version:    old.Version,
+			Body:       old.Body,
+			ReplacedAt: entry.Time,
+		})
+		s.Chirps[entry.Chirp.Id] = *entry.Chirp
+		s.indexChirp(*entry.Chirp)
+	case opChirpDeleted:
+		if old, ok := s.Chirps[entry.Id]; ok {
+			s.unindexChirp(old)
+			delete(s.Chirps, entry.Id)
+			delete(s.ChirpHistory, entry.Id)
+			s.setLikes(entry.Id, nil)
+		}
+	case opChirpScheduled:
+		s.Scheduled[entry.Chirp.Id] = *entry.Chirp
+		s.ScheduledId = max(s.ScheduledId, entry.Chirp.Id)
+	case opChirpUnscheduled:
+		delete(s.Scheduled, entry.Id)
+	case opLikeAdded:
+		s.Likes[entry.Id] = insertSorted(s.Likes[entry.Id], entry.UserId)
+		s.idx.likesByUser[entry.UserId] = insertSorted(s.idx.likesByUser[entry.UserId], entry.Id)
+	case opLikeRemoved:
+		removeFromIndex(s.Likes, entry.Id, entry.UserId)
+		removeFromIndex(s.idx.likesByUser, entry.UserId, entry.Id)
+	case opUserCreated, opUserUpdated:
+		user := *entry.User
+		// keep the email map clean, so it doesn't cause issues
+		if old, ok := s.Users[user.Id]; ok && old.Email != user.Email {
+			delete(s.Emails, old.Email)
+			removeFromIndex(s.idx.handles, handleOf(old.Email), old.Id)
+		}
+		s.Users[user.Id] = user
+		s.Emails[user.Email] = user.Id
+		s.idx.handles[handleOf(user.Email)] = insertSorted(s.idx.handles[handleOf(user.Email)], user.Id)
+		s.UserId = max(s.UserId, user.Id)
+	case opUserDeleted:
+		if old, ok := s.Users[entry.Id]; ok {
+			delete(s.Emails, old.Email)
+			removeFromIndex(s.idx.handles, handleOf(old.Email), old.Id)
+			delete(s.Users, entry.Id)
+		}
+	case opTokenIssued:
+		s.RefreshTokens[entry.Token] = *entry.RefreshToken
+	case opTokenRevoked:
+		delete(s.RefreshTokens, entry.Token)
+	default:
+		return fmt.Errorf("unknown journal op %q", entry.Op)
+	}
+
+	return nil
+}
+
+// checkEntrySchema refuses entries written by a build with another schema.
+// Migrations only upgrade snapshots: an older entry would be applied without
+// the fields later versions added, and nothing can be done with a newer one.
+func checkEntrySchema(entry journalEntry, unstamped int) error {
+	schema := entry.Schema
+	if schema == 0 {
+		schema = unstamped
+	}
+	if schema > currentSchemaVersion {
+		return fmt.Errorf("%w: schema v%d, this build supports v%d", errSchemaTooNew, schema, currentSchemaVersion)
+	}
+	if schema < currentSchemaVersion {
+		return fmt.Errorf("%w: written with schema v%d, this build writes v%d. Start the build that wrote it once and stop it again, which folds the journal into the snapshot, then upgrade", errJournalTooOld, schema, currentSchemaVersion)
+	}
+
+	return nil
+}
+
+// openJournal opens the journal for appending. It holds the same secrets as
+// the snapshots, so it is only readable by its owner like them.
+func openJournal(path string) (*os.File, error) {
+	journal, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// created by a build that made it world readable
+	err = journal.Chmod(0o600)
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+func encodeEntry(entry journalEntry, c *dbCipher) ([]byte, error) {
+	entry.Schema = currentSchemaVersion
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(c.seal(data), '\n'), nil
+}
+
+// writeJournal appends already encoded entries, waits for them to hit the
+// disk and returns the new end of the file. A short write is cut off again so
+// a retry doesn't leave a broken line in the middle of the file.
+func writeJournal(journal *os.File, data []byte) (int64, error) {
+	offset, err := journal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = journal.Write(data)
+	if err != nil {
+		journal.Truncate(offset)
+		return 0, err
+	}
+
+	return offset + int64(len(data)), journal.Sync()
+}
+
+// replayJournal applies every entry from offset on that is newer than data,
+// returning how many were applied and where the journal ends. A torn last
+// line (crash mid-append) is dropped; anything unreadable before that is an
+// error, and so is a plaintext entry with a key unless allowPlain.
+func replayJournal(journal *os.File, data *DBStructure, offset int64, c *dbCipher, allowPlain bool) (int, int64, error) {
+	_, err := journal.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, offset, err
+	}
+
+	applied := 0
+	goodOffset := offset
+	reader := bufio.NewReader(journal)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("dropping incomplete journal entry at offset %d", goodOffset)
+				return applied, goodOffset, journal.Truncate(goodOffset)
+			}
+			return applied, goodOffset, nil
+		} else if err != nil {
+			return applied, goodOffset, err
+		}
+
+		plain, _, err := c.open(bytes.TrimSuffix(line, []byte("\n")), allowPlain)
+		if err != nil {
+			return applied, goodOffset, fmt.Errorf("journal entry at offset %d: %w", goodOffset, err)
+		}
+		entry := journalEntry{}
+		err = json.Unmarshal(plain, &entry)
+		if err != nil {
+			return applied, goodOffset, fmt.Errorf("journal entry at offset %d: %w", goodOffset, err)
+		}
+		goodOffset += int64(len(line))
+
+		if entry.Seq <= data.Seq {
+			// already part of the snapshot
+			continue
+		}
+		err = checkEntrySchema(entry, data.journalSchema)
+		if err != nil {
+			return applied, goodOffset, fmt.Errorf("journal entry at offset %d: %w", goodOffset, err)
+		}
+		if applied == 0 && entry.Seq != data.Seq+1 {
+			log.Printf("journal resumes at seq %d but the snapshot ends at seq %d, changes in between are lost", entry.Seq, data.Seq)
+		}
+		err = data.apply(entry)
+		if err != nil {
+			return applied, goodOffset, err
+		}
+		data.Seq = entry.Seq
+		applied++
+	}
+}
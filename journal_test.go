@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReplayRefusesOldJournals(t *testing.T) {
+	const user = `"user":{"id":1,"email":"ada@example.com","password":"aGFzaA==","version":1}`
+	tests := []struct {
+		name     string
+		snapshot int
+		entry    string
+		want     error
+	}{
+		{"unstamped, current snapshot", currentSchemaVersion, `{"seq":1,"op":"user.created","id":1,` + user + `}`, nil},
+		{"stamped, current", 2, fmt.Sprintf(`{"seq":1,"op":"user.created","id":1,"schema":%d,`+user+`}`, currentSchemaVersion), nil},
+		{"unstamped, old snapshot", 2, `{"seq":1,"op":"user.created","id":1,` + user + `}`, errJournalTooOld},
+		{"stamped, old", currentSchemaVersion, `{"seq":1,"op":"user.created","id":1,"schema":3,` + user + `}`, errJournalTooOld},
+		{"stamped, newer", currentSchemaVersion, fmt.Sprintf(`{"seq":1,"op":"user.created","id":1,"schema":%d,`+user+`}`, currentSchemaVersion+1), errSchemaTooNew},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			snapshot := fmt.Sprintf(`{"chirps":{},"users":{},"emails":{},"refreshTokens":{},"chirpHistory":{},"likes":{},"scheduled":{},"seq":0,"schema_version":%d}`, test.snapshot)
+			err := os.WriteFile(path, []byte(snapshot), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path+".log", []byte(test.entry+"\n"), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := NewDB(path, DBOptions{})
+			if !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+			if err != nil {
+				return
+			}
+			defer db.Close()
+			db.View(UsersScope, func(tx Tx) error {
+				_, err = tx.UserByEmail("ada@example.com")
+				return nil
+			})
+			if err != nil {
+				t.Errorf("the entry wasn't replayed: %s", err)
+			}
+		})
+	}
+}
+
+// newJournaledDB returns a DB at a fresh path holding n users, whose
+// creation is still only in the journal
+func newJournaledDB(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, DBOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		err = db.Update(UsersScope, func(tx Tx) error {
+			_, err := tx.CreateUser(fmt.Sprintf("user%d@example.com", i+1), []byte("hash"))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no Close, that would fold the journal into the snapshot
+
+	return path
+}
+
+func journalLines(t *testing.T, path string) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(path + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	// everything after the last newline, nothing for a healthy journal
+	return lines[:len(lines)-1]
+}
+
+func userIds(t *testing.T, db *DB) []int {
+	t.Helper()
+	ids := []int{}
+	db.View(UsersScope, func(tx Tx) error {
+		for id := 1; id <= 5; id++ {
+			if _, err := tx.User(id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	return ids
+}
+
+func TestReplayDropsTornLastLine(t *testing.T) {
+	path := newJournaledDB(t, 2)
+	lines := journalLines(t, path)
+	if len(lines) != 2 {
+		t.Fatalf("journal has %d lines, want 2", len(lines))
+	}
+	// a crash halfway through appending the second entry
+	torn := append(slices.Clone(lines[0]), lines[1][:len(lines[1])/2]...)
+	err := os.WriteFile(path+".log", torn, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path, DBOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if ids := userIds(t, db); !slices.Equal(ids, []int{1}) {
+		t.Errorf("recovered users %v, want [1]", ids)
+	}
+	// folded into the snapshot, torn line and all
+	info, err := os.Stat(path + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("journal is %d bytes after recovery, want 0", info.Size())
+	}
+}
+
+func TestReplayWarnsAboutGaps(t *testing.T) {
+	path := newJournaledDB(t, 3)
+	lines := journalLines(t, path)
+	// the entry for seq 1 is lost
+	err := os.WriteFile(path+".log", bytes.Join(lines[1:], nil), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := bytes.Buffer{}
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	db, err := NewDB(path, DBOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if !strings.Contains(logged.String(), "journal resumes at seq 2 but the snapshot ends at seq 0") {
+		t.Errorf("no warning about the gap in:\n%s", logged.String())
+	}
+	if ids := userIds(t, db); !slices.Equal(ids, []int{2, 3}) {
+		t.Errorf("recovered users %v, want [2 3]", ids)
+	}
+}
@@ -1,57 +1,293 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/joho/godotenv"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	dbFile := "database.json"
-	dbg := flag.Bool("debug", false, "Enable debug mode")
+	dbFile := flag.String("db", "database.json", "Path of the db file, its journal and backups go next to it")
+	dbg := flag.Bool("debug", false, "Start with an empty db, deleting the existing one")
+	seedFile := flag.String("seed", "", "Start with a db holding only the users, chirps and tokens in this JSON fixture")
+	fakeUsers := flag.Int("fake-users", 0, "Start with a db holding this many made up users and their chirps")
+	storeType := flag.String("store", "json", "Storage backend: json or memory")
+	addr := flag.String("addr", ":8080", "Address to listen on")
+	sharedDB := flag.Bool("shared-db", false, "Lock the db files so several processes can use them at once")
+	flushInterval := flag.Duration("flush-interval", 0, "Batch journal writes for this long, 0 writes every change immediately")
+	sweepInterval := flag.Duration("sweep-interval", time.Hour, "How often to purge expired records, 0 disables it")
+	publishInterval := flag.Duration("publish-interval", 10*time.Second, "How often to publish scheduled chirps that are due, 0 disables it")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "Report the schema migrations the db file needs and exit")
+	checkOnStart := flag.Bool("check", false, "Check the db for inconsistencies on startup and log them")
+	encryptDB := flag.Bool("encrypt-db", false, "Encrypt a plaintext db with DB_ENCRYPTION_KEY on startup")
 	flag.Parse()
-	if *dbg {
-		err := os.Remove(dbFile)
-		if err != nil {
-			log.Fatal("Couldn't delete db file")
-		}
-	}
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Couldn't load env file")
 	}
+	encryptionKey, oldEncryptionKeys, err := encryptionKeysFromEnv()
+	if err != nil {
+		log.Fatalf("Bad encryption key: %s", err)
+	}
+	dbOptions := DBOptions{
+		FlushInterval:     *flushInterval,
+		Shared:            *sharedDB,
+		EncryptionKey:     encryptionKey,
+		OldEncryptionKeys: oldEncryptionKeys,
+		EncryptPlaintext:  *encryptDB,
+	}
+	if *migrateDryRun {
+		notes, err := DryRunMigrations(*dbFile, dbOptions)
+		if err != nil {
+			log.Fatalf("Can't plan migrations: %s", err)
+		}
+		if len(notes) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		for _, note := range notes {
+			fmt.Println(note)
+		}
+		return
+	}
+	if flag.NArg() > 0 {
+		err = runCommand(*dbFile, dbOptions, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	fresh := *dbg || *seedFile != "" || *fakeUsers > 0
+	if fresh && *storeType == "json" {
+		err = wipeDB(*dbFile)
+		if err != nil {
+			log.Fatalf("Couldn't delete db files: %s", err)
+		}
+	}
 
 	mux := http.NewServeMux()
 	serverConfig := Server{
-		Addr: ":8080",
+		Addr: *addr,
 	}
 	apiCfg := apiConfig{
 		fileserverHits: 0,
 		jwtSecret:      os.Getenv("JWT_SECRET"),
 		polkaKey:       os.Getenv("POLKA_KEY"),
+		adminKey:       os.Getenv("ADMIN_KEY"),
+		maintenance:    newMaintenanceStats(),
 	}
 
-	db, err := NewDB(dbFile)
-	if err != nil {
-		log.Fatal("Can't connect to db")
+	switch *storeType {
+	case "json":
+		db, err := NewDB(*dbFile, dbOptions)
+		if errors.Is(err, errPlaintext) {
+			log.Fatalf("Can't connect to db: %s. Start once with --encrypt-db to encrypt it", err)
+		} else if err != nil {
+			log.Fatalf("Can't connect to db: %s", err)
+		}
+		apiCfg.store = db
+		if *checkOnStart {
+			violations, err := db.Check(false)
+			if err != nil {
+				log.Fatalf("Can't check db: %s", err)
+			}
+			for _, v := range violations {
+				log.Printf("check: %s %s: %s", v.Check, v.Record, v.Detail)
+			}
+			if len(violations) > 0 {
+				log.Printf("found %d problems, run `check --fix` to repair the safe ones", len(violations))
+			}
+		}
+	case "memory":
+		apiCfg.store = NewMemoryStore()
+	default:
+		log.Fatalf("Unknown store type: %s", *storeType)
+	}
+
+	if *seedFile != "" {
+		fixture, err := loadFixture(*seedFile)
+		if err != nil {
+			log.Fatalf("Can't read fixture: %s", err)
+		}
+		err = seedStore(apiCfg.store, fixture)
+		if err != nil {
+			log.Fatalf("Can't seed db: %s", err)
+		}
+		log.Printf("seeded %d users, %d chirps and %d refresh tokens from %s", len(fixture.Users), len(fixture.Chirps), len(fixture.RefreshTokens), *seedFile)
+	}
+	if *fakeUsers > 0 {
+		err = seedStore(apiCfg.store, fakeFixture(*fakeUsers, 1))
+		if err != nil {
+			log.Fatalf("Can't seed db: %s", err)
+		}
+		log.Printf("seeded %d fake users, their password is \"password\"", *fakeUsers)
 	}
 
-	mux.Handle("GET /app/", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("./")))))
+	mux.Handle("GET /app/", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", serveStatic(*dbFile, http.FileServer(http.Dir("./"))))))
 	mux.HandleFunc("GET /admin/metrics", apiCfg.getCount)
+	mux.HandleFunc("GET /admin/backup", apiCfg.backup)
+	mux.HandleFunc("POST /admin/restore", apiCfg.restore)
+	mux.HandleFunc("GET /admin/events", apiCfg.streamEvents)
 	mux.HandleFunc("GET /api/reset", apiCfg.resetCount)
 	mux.HandleFunc("GET /api/healthz", healthz)
-	mux.HandleFunc("POST /api/chirps", db.createChirp(apiCfg))
-	mux.HandleFunc("GET /api/chirps", db.getAllChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", db.getChirp)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", db.deleteChirp(apiCfg))
-	mux.HandleFunc("POST /api/users", db.createUser)
-	mux.HandleFunc("PUT /api/users", db.updateUser(apiCfg))
-	mux.HandleFunc("POST /api/login", db.userLogin(apiCfg))
-	mux.HandleFunc("POST /api/revoke", db.revokeRefresh)
-	mux.HandleFunc("POST /api/refresh", db.refresh(apiCfg))
-	mux.HandleFunc("POST /api/polka/webhooks", db.polkaWebhook(apiCfg))
-	http.ListenAndServe(serverConfig.Addr, mux)
+	mux.HandleFunc("POST /api/chirps", apiCfg.createChirp)
+	mux.HandleFunc("GET /api/chirps", apiCfg.getAllChirps)
+	mux.HandleFunc("GET /api/chirps/search", apiCfg.searchChirps)
+	mux.HandleFunc("GET /api/scheduled-chirps", apiCfg.getScheduledChirps)
+	mux.HandleFunc("PUT /api/scheduled-chirps/{scheduledID}", apiCfg.rescheduleChirp)
+	mux.HandleFunc("DELETE /api/scheduled-chirps/{scheduledID}", apiCfg.cancelScheduledChirp)
+	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.getChirp)
+	mux.HandleFunc("PUT /api/chirps/{chirpID}", apiCfg.updateChirp)
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.deleteChirp)
+	mux.HandleFunc("GET /api/chirps/{chirpID}/history", apiCfg.getChirpHistory)
+	mux.HandleFunc("GET /api/chirps/{chirpID}/thread", apiCfg.getThread)
+	mux.HandleFunc("POST /api/chirps/{chirpID}/likes", apiCfg.likeChirp)
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}/likes", apiCfg.unlikeChirp)
+	mux.HandleFunc("POST /api/users", apiCfg.createUser)
+	mux.HandleFunc("PUT /api/users", apiCfg.updateUser)
+	mux.HandleFunc("GET /api/users/{userID}/likes", apiCfg.getLikedChirps)
+	mux.HandleFunc("GET /api/users/{userID}/mentions", apiCfg.getMentions)
+	mux.HandleFunc("GET /api/hashtags/{tag}", apiCfg.getHashtagChirps)
+	mux.HandleFunc("POST /api/login", apiCfg.userLogin)
+	mux.HandleFunc("POST /api/revoke", apiCfg.revokeRefresh)
+	mux.HandleFunc("POST /api/refresh", apiCfg.refresh)
+	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.polkaWebhook)
+
+	ctx, stopBackground := context.WithCancel(context.Background())
+	if *sweepInterval > 0 {
+		go apiCfg.runMaintenance(ctx, *sweepInterval)
+	}
+	if *publishInterval > 0 {
+		go apiCfg.runPublisher(ctx, *publishInterval)
+	}
+
+	server := &http.Server{
+		Addr:    serverConfig.Addr,
+		Handler: mux,
+		// cancelled on shutdown, so event streams end instead of holding it up
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server failed: %s", err)
+		}
+	}()
+
+	// let in flight requests finish and get batched writes to disk before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	stopBackground()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("failed to shut down cleanly: %s", err)
+	}
+	err = apiCfg.store.Close()
+	if err != nil {
+		log.Printf("failed to close db: %s", err)
+	}
+}
 
+// runCommand handles the subcommands that work on the db file and exit. The
+// db is opened shared so they can run next to a server started with
+// --shared-db.
+func runCommand(dbFile string, opts DBOptions, args []string) error {
+	opts.Shared = true
+	switch args[0] {
+	case "backup":
+		flags := flag.NewFlagSet("backup", flag.ExitOnError)
+		plaintext := flags.Bool("plaintext", false, "Write the backup unencrypted even if DB_ENCRYPTION_KEY is set")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return errors.New("usage: backup [--plaintext] <file>")
+		}
+		path := flags.Arg(0)
+		// it has every password hash and refresh token
+		if isServed(path) {
+			return fmt.Errorf("%s would be served under /app/, write the backup somewhere else", path)
+		}
+		if !*plaintext && opts.EncryptionKey == nil {
+			return errors.New("no DB_ENCRYPTION_KEY to seal the backup with, pass --plaintext to write it unencrypted")
+		}
+		db, err := NewDB(dbFile, opts)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		// in case it already existed with a looser mode
+		err = file.Chmod(0o600)
+		if err == nil && *plaintext {
+			err = db.Backup(file)
+		} else if err == nil {
+			err = db.BackupSealed(file)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	case "restore":
+		if len(args) != 2 {
+			return errors.New("usage: restore <file>")
+		}
+		file, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		db, err := NewDB(dbFile, opts)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.Restore(file)
+	case "check":
+		flags := flag.NewFlagSet("check", flag.ExitOnError)
+		fix := flags.Bool("fix", false, "Repair the problems that can be repaired safely")
+		flags.Parse(args[1:])
+		db, err := NewDB(dbFile, opts)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		violations, err := db.Check(*fix)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(violations)
+		if err != nil {
+			return err
+		}
+		unfixed := 0
+		for _, v := range violations {
+			if !v.Fixed {
+				unfixed++
+			}
+		}
+		if unfixed > 0 {
+			return fmt.Errorf("%d of %d problems not fixed", unfixed, len(violations))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// sweep is one cleanup job run by the maintenance loop. It returns how many
+// records it removed.
+type sweep struct {
+	name  string
+	scope Scope
+	run   func(tx Tx, now time.Time) (int, error)
+}
+
+var sweeps = []sweep{
+	{name: "expired refresh tokens", scope: TokensScope, run: Tx.PurgeExpiredRefreshTokens},
+}
+
+// maintenanceStats is what the loop reports on /admin/metrics
+type maintenanceStats struct {
+	mux     sync.Mutex
+	lastRun time.Time
+	removed map[string]int
+}
+
+func newMaintenanceStats() *maintenanceStats {
+	return &maintenanceStats{
+		removed: map[string]int{},
+	}
+}
+
+func (stats *maintenanceStats) record(name string, removed int, now time.Time) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+
+	stats.removed[name] += removed
+	stats.lastRun = now
+}
+
+func (stats *maintenanceStats) snapshot() (time.Time, map[string]int) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+
+	removed := map[string]int{}
+	for name, count := range stats.removed {
+		removed[name] = count
+	}
+
+	return stats.lastRun, removed
+}
+
+// runMaintenance runs every sweep once per interval until ctx is cancelled.
+// Each sweep gets its own transaction so one failing doesn't hold up the rest.
+func (apiCfg *apiConfig) runMaintenance(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			apiCfg.sweepOnce(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (apiCfg *apiConfig) sweepOnce(now time.Time) {
+	for _, s := range sweeps {
+		removed := 0
+		err := apiCfg.store.Update(s.scope, func(tx Tx) error {
+			var err error
+			removed, err = s.run(tx, now)
+			return err
+		})
+		if err != nil {
+			log.Printf("failed to sweep %s: %s", s.name, err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("swept %d %s", removed, s.name)
+		}
+		apiCfg.maintenance.record(s.name, removed, now)
+	}
+}
+
+// runPublisher publishes scheduled chirps as they come due. The queue is in
+// the db, so it starts with a round right away for anything that came due
+// while the server was down.
+func (apiCfg *apiConfig) runPublisher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		published := 0
+		err := apiCfg.store.Update(ChirpsScope, func(tx Tx) error {
+			var err error
+			published, err = tx.PublishDueChirps(time.Now())
+			return err
+		})
+		if err != nil {
+			log.Printf("failed to publish scheduled chirps: %s", err)
+		} else if published > 0 {
+			log.Printf("published %d scheduled chirps", published)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"time"
 )
 
 func (apiCfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -21,8 +23,28 @@ func (apiCfg *apiConfig) resetCount(w http.ResponseWriter, req *http.Request) {
 }
 
 func (apiCfg *apiConfig) getCount(w http.ResponseWriter, req *http.Request) {
-	template := "<html>\n\n<body>\n    <h1>Welcome, Chirpy Admin</h1>\n    <p>Chirpy has been visited %d times!</p>\n</body>\n\n</html>"
+	template := "<html>\n\n<body>\n    <h1>Welcome, Chirpy Admin</h1>\n    <p>Chirpy has been visited %d times!</p>\n%s</body>\n\n</html>"
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, template, apiCfg.fileserverHits)
+	fmt.Fprintf(w, template, apiCfg.fileserverHits, apiCfg.maintenanceMetrics())
+}
+
+func (apiCfg *apiConfig) maintenanceMetrics() string {
+	lastRun, removed := apiCfg.maintenance.snapshot()
+	if lastRun.IsZero() {
+		return "    <p>Maintenance hasn't run yet.</p>\n"
+	}
+
+	names := []string{}
+	for name := range removed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	html := fmt.Sprintf("    <p>Maintenance last ran at %s.</p>\n", lastRun.Format(time.RFC3339))
+	for _, name := range names {
+		html += fmt.Sprintf("    <p>Swept %d %s.</p>\n", removed[name], name)
+	}
+
+	return html
 }
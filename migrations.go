@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// currentSchemaVersion is what this build writes. Bump it together with a new
+// entry at the end of migrations.
+const currentSchemaVersion = 5
+
+var (
+	errSchemaTooNew  = errors.New("db file was written by a newer version")
+	errJournalTooOld = errors.New("journal was written by an older version")
+)
+
+type migration struct {
+	version     int
+	description string
+	// migrate edits a decoded snapshot in place and returns a short note for
+	// each kind of change it made
+	migrate func(snapshot map[string]interface{}) ([]string, error)
+}
+
+// migrations run in order on any snapshot older than their version. Journal
+// entries are never migrated: a journal written by an older version is
+// refused, see checkEntrySchema.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "start recording schema_version",
+		migrate: func(snapshot map[string]interface{}) ([]string, error) {
+			return nil, nil
+		},
+	},
+	{
+		version:     2,
+		description: "add a version to chirps and users",
+		migrate: func(snapshot map[string]interface{}) ([]string, error) {
+			notes := []string{}
+			for _, collection := range []string{"chirps", "users"} {
+				records, _ := snapshot[collection].(map[string]interface{})
+				for _, record := range records {
+					record, ok := record.(map[string]interface{})
+					if !ok {
+						return nil, fmt.Errorf("%s holds something that isn't a record", collection)
+					}
+					record["version"] = 1
+				}
+				notes = append(notes, fmt.Sprintf("set version 1 on %d %s", len(records), collection))
+			}
+			return notes, nil
+		},
+	},
+	{
+		version:     3,
+		description: "extract hashtags and mentions from chirp bodies",
+		migrate: func(snapshot map[string]interface{}) ([]string, error) {
+			owners := map[string][]int{}
+			users, _ := snapshot["users"].(map[string]interface{})
+			for key, record := range users {
+				record, _ := record.(map[string]interface{})
+				email, _ := record["email"].(string)
+				id, err := strconv.Atoi(key)
+				if err != nil {
+					return nil, fmt.Errorf("user id %q isn't a number", key)
+				}
+				owners[handleOf(email)] = append(owners[handleOf(email)], id)
+			}
+
+			tagged := 0
+			chirps, _ := snapshot["chirps"].(map[string]interface{})
+			for _, record := range chirps {
+				record, ok := record.(map[string]interface{})
+				if !ok {
+					return nil, errors.New("chirps holds something that isn't a record")
+				}
+				body, _ := record["body"].(string)
+				hashtags, handles := extractTags(body)
+				mentions := resolveMentions(handles, owners)
+				if len(hashtags) > 0 {
+					record["hashtags"] = hashtags
+				}
+				if len(mentions) > 0 {
+					record["mentions"] = mentions
+				}
+				if len(hashtags) > 0 || len(mentions) > 0 {
+					tagged++
+				}
+			}
+			return []string{fmt.Sprintf("found hashtags or mentions in %d of %d chirps", tagged, len(chirps))}, nil
+		},
+	},
+	{
+		version:     4,
+		description: "add created_at and updated_at to chirps and users",
+		migrate: func(snapshot map[string]interface{}) ([]string, error) {
+			// nothing says when older records were written, so they get the
+			// time of the upgrade, which they all existed by. Ids still give
+			// their order.
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			notes := []string{}
+			for _, collection := range []string{"chirps", "users"} {
+				records, _ := snapshot[collection].(map[string]interface{})
+				for _, record := range records {
+					record, ok := record.(map[string]interface{})
+					if !ok {
+						return nil, fmt.Errorf("%s holds something that isn't a record", collection)
+					}
+					record["created_at"] = now
+					record["updated_at"] = now
+				}
+				notes = append(notes, fmt.Sprintf("set created_at and updated_at to %s on %d %s", now, len(records), collection))
+			}
+			return notes, nil
+		},
+	},
+	{
+		version:     5,
+		description: "give scheduled chirps their own id counter",
+		migrate: func(snapshot map[string]interface{}) ([]string, error) {
+			// queued chirps keep the chirp ids they were given, the counter
+			// just has to start past them
+			scheduledId := 0
+			scheduled, _ := snapshot["scheduled"].(map[string]interface{})
+			for key := range scheduled {
+				id, err := strconv.Atoi(key)
+				if err != nil {
+					return nil, fmt.Errorf("scheduled chirp id %q isn't a number", key)
+				}
+				scheduledId = max(scheduledId, id)
+			}
+			snapshot["scheduledId"] = scheduledId
+			return []string{fmt.Sprintf("set scheduledId to %d for %d scheduled chirps", scheduledId, len(scheduled))}, nil
+		},
+	},
+}
+
+func schemaVersionOf(data []byte) (int, error) {
+	versioned := struct {
+		SchemaVersion int `json:"schema_version"`
+	}{}
+	err := json.Unmarshal(data, &versioned)
+	if err != nil {
+		return 0, err
+	}
+
+	return versioned.SchemaVersion, nil
+}
+
+// runMigrations upgrades a raw snapshot to currentSchemaVersion and describes
+// what it did. A snapshot that is already current comes back untouched with no
+// notes.
+func runMigrations(data []byte) ([]byte, []string, error) {
+	version, err := schemaVersionOf(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version > currentSchemaVersion {
+		return nil, nil, fmt.Errorf("%w: schema v%d, this build supports v%d", errSchemaTooNew, version, currentSchemaVersion)
+	}
+	if version == currentSchemaVersion {
+		return data, nil, nil
+	}
+
+	snapshot := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// keep big numbers like token expirations exact
+	decoder.UseNumber()
+	err = decoder.Decode(&snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notes := []string{}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		changes, err := m.migrate(snapshot)
+		if err != nil {
+			return nil, nil, fmt.Errorf("migration to v%d: %w", m.version, err)
+		}
+		notes = append(notes, fmt.Sprintf("v%d: %s", m.version, m.description))
+		for _, change := range changes {
+			notes = append(notes, "  "+change)
+		}
+		snapshot["schema_version"] = m.version
+	}
+
+	migrated, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return migrated, notes, nil
+}
+
+// migrateSnapshot upgrades the decrypted snapshot read from path. The original
+// file contents are saved next to it as path.v<version>.bak before anything
+// else happens, since the migrated state will replace path on the next
+// snapshot.
+func migrateSnapshot(path string, data []byte, original []byte) ([]byte, bool, error) {
+	version, err := schemaVersionOf(data)
+	if err != nil {
+		return nil, false, err
+	}
+	migrated, notes, err := runMigrations(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(notes) == 0 {
+		return data, false, nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", path, version)
+	err = writeFileAtomic(backup, original)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to back up %s before migrating: %w", path, err)
+	}
+	log.Printf("migrating %s from schema v%d to v%d, backup in %s", path, version, currentSchemaVersion, backup)
+	for _, note := range notes {
+		log.Print(note)
+	}
+
+	return migrated, true, nil
+}
+
+// DryRunMigrations reports what NewDB would do to the snapshot at path
+// without writing anything.
+func DryRunMigrations(path string, opts DBOptions) ([]string, error) {
+	c, err := newDBCipher(opts.EncryptionKey, opts.OldEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) || len(raw) == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data, _, err := c.open(raw, true)
+	if err != nil {
+		return nil, err
+	}
+
+	_, notes, err := runMigrations(data)
+	return notes, err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var errEmptySearch = errors.New("search needs at least one word")
+
+// SearchQuery is a parsed search. Every term has to appear in a chirp, and
+// every phrase has to appear in it word for word.
+type SearchQuery struct {
+	Terms    []string
+	Phrases  [][]string
+	AuthorId int
+	// by relevance unless set
+	Recent bool
+	Limit  int
+}
+
+// tokenize splits text into lower case words, which is all the index knows
+// about
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// parseSearch reads `some words "an exact phrase"`. Words outside quotes can
+// appear anywhere in the chirp.
+func parseSearch(text string) (SearchQuery, error) {
+	q := SearchQuery{}
+	for i, part := range strings.Split(text, `"`) {
+		words := tokenize(part)
+		// odd parts were inside quotes
+		if i%2 == 1 && len(words) > 1 {
+			q.Phrases = append(q.Phrases, words)
+		}
+		for _, word := range words {
+			if !slices.Contains(q.Terms, word) {
+				q.Terms = append(q.Terms, word)
+			}
+		}
+	}
+	if len(q.Terms) == 0 {
+		return SearchQuery{}, errEmptySearch
+	}
+
+	return q, nil
+}
+
+// searchChirps intersects the posting lists of every term, starting with the
+// shortest, then checks phrases and scores what is left
+func (s *DBStructure) searchChirps(q SearchQuery) []Chirp {
+	postings := [][]int{}
+	for _, term := range q.Terms {
+		postings = append(postings, s.idx.terms[term])
+	}
+	sort.Slice(postings, func(i, j int) bool {
+		return len(postings[i]) < len(postings[j])
+	})
+
+	candidates := postings[0]
+	for _, ids := range postings[1:] {
+		candidates = intersectSorted(candidates, ids)
+	}
+
+	type hit struct {
+		chirp Chirp
+		score float64
+	}
+	hits := []hit{}
+	for _, id := range candidates {
+		chirp := s.Chirps[id]
+		if q.AuthorId != 0 && chirp.AuthorId != q.AuthorId {
+			continue
+		}
+		words := tokenize(chirp.Body)
+		if !containsPhrases(words, q.Phrases) {
+			continue
+		}
+		// tf-idf: rare terms count for more than common ones
+		score := 0.0
+		for _, term := range q.Terms {
+			tf := 0
+			for _, word := range words {
+				if word == term {
+					tf++
+				}
+			}
+			idf := math.Log(1 + float64(len(s.Chirps))/float64(len(s.idx.terms[term])))
+			score += float64(tf) * idf / float64(len(words))
+		}
+		hits = append(hits, hit{chirp: chirp, score: score})
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		if !q.Recent && hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].chirp.Id > hits[j].chirp.Id
+	})
+	chirps := []Chirp{}
+	for _, h := range hits {
+		if q.Limit > 0 && len(chirps) == q.Limit {
+			break
+		}
+		chirps = append(chirps, s.withCounts(h.chirp))
+	}
+
+	return chirps
+}
+
+func containsPhrases(words []string, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		found := false
+		for i := 0; i+len(phrase) <= len(words); i++ {
+			if slices.Equal(words[i:i+len(phrase)], phrase) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func intersectSorted(a []int, b []int) []int {
+	both := []int{}
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			both = append(both, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+
+	return both
+}
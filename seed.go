@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// Fixture is what --seed loads. Chirps and tokens refer to their user by
+// email so fixtures don't depend on the ids they end up with.
+type Fixture struct {
+	Users         []FixtureUser  `json:"users"`
+	Chirps        []FixtureChirp `json:"chirps"`
+	RefreshTokens []FixtureToken `json:"refresh_tokens"`
+}
+
+type FixtureUser struct {
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+}
+
+type FixtureChirp struct {
+	Author string `json:"author"`
+	Body   string `json:"body"`
+}
+
+type FixtureToken struct {
+	Token string `json:"token"`
+	User  string `json:"user"`
+	// defaults to the 60 days a login gets
+	ExpiresInSeconds int64 `json:"expires_in_seconds"`
+}
+
+func loadFixture(path string) (Fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Fixture{}, err
+	}
+	defer file.Close()
+
+	fixture := Fixture{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&fixture)
+	if err != nil {
+		return Fixture{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return fixture, nil
+}
+
+// seedStore adds everything in fixture in one transaction, so a bad fixture
+// leaves the store empty rather than half seeded.
+func seedStore(store Store, fixture Fixture) error {
+	// hashing is slow, do it before taking any locks and only once per password
+	hashes := map[string][]byte{}
+	for _, u := range fixture.Users {
+		if _, ok := hashes[u.Password]; ok {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		hashes[u.Password] = hash
+	}
+
+	now := time.Now()
+	return store.Update(AllScopes, func(tx Tx) error {
+		for _, u := range fixture.Users {
+			if u.Email == "" || u.Password == "" {
+				return errors.New("fixture users need an email and a password")
+			}
+			user, err := tx.CreateUser(u.Email, hashes[u.Password])
+			if err != nil {
+				return fmt.Errorf("user %s: %w", u.Email, err)
+			}
+			if u.IsChirpyRed {
+				user.IsChirpyRed = true
+				_, err = tx.UpdateUser(user)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, c := range fixture.Chirps {
+			author, err := tx.UserByEmail(c.Author)
+			if err != nil {
+				return fmt.Errorf("chirp by %s: %w", c.Author, err)
+			}
+			if len(c.Body) > 140 {
+				return fmt.Errorf("chirp by %s is too long", c.Author)
+			}
+			_, err = tx.CreateChirp(Chirp{Body: cleanString(c.Body), AuthorId: author.Id})
+			if err != nil {
+				return err
+			}
+		}
+		for _, t := range fixture.RefreshTokens {
+			user, err := tx.UserByEmail(t.User)
+			if err != nil {
+				return fmt.Errorf("token of %s: %w", t.User, err)
+			}
+			if t.Token == "" {
+				t.Token = generateRefreshToken()
+			}
+			if t.ExpiresInSeconds == 0 {
+				t.ExpiresInSeconds = 5184000
+			}
+			err = tx.SaveRefreshToken(t.Token, RefreshToken{
+				UserId:     user.Id,
+				Expiration: now.Unix() + t.ExpiresInSeconds,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+var (
+	fakeFirstNames = []string{"ada", "alan", "grace", "linus", "margaret", "ken", "barbara", "dennis", "frances", "edsger", "radia", "donald", "sophie", "guido", "anita", "rob"}
+	fakeLastNames  = []string{"lovelace", "turing", "hopper", "torvalds", "hamilton", "thompson", "liskov", "ritchie", "allen", "dijkstra", "perlman", "knuth", "wilson", "rossum", "borg", "pike"}
+	fakeOpeners    = []string{"Just", "Finally", "Still", "Honestly, I", "Today I", "Can't believe I", "Pretty sure I", "Somehow I"}
+	fakeVerbs      = []string{"shipped", "broke", "refactored", "deleted", "benchmarked", "rewrote", "reviewed", "debugged", "documented", "deployed"}
+	fakeObjects    = []string{"the build", "a flaky test", "the whole parser", "my side project", "the on-call runbook", "a race condition", "the login page", "three microservices", "the database", "a regex"}
+	fakeEndings    = []string{".", "!", " before lunch.", " on a Friday.", " and it worked.", " again.", ", send coffee.", " in production."}
+)
+
+// fakeFixture makes up users chirping about their day. Everyone's password is
+// "password". The same seed always gives the same data.
+func fakeFixture(users int, seed uint64) Fixture {
+	r := rand.New(rand.NewPCG(seed, seed))
+	pick := func(words []string) string {
+		return words[r.IntN(len(words))]
+	}
+
+	fixture := Fixture{}
+	for i := 1; i <= users; i++ {
+		fixture.Users = append(fixture.Users, FixtureUser{
+			Email:       fmt.Sprintf("%s.%s%d@example.com", pick(fakeFirstNames), pick(fakeLastNames), i),
+			Password:    "password",
+			IsChirpyRed: r.IntN(4) == 0,
+		})
+	}
+	// an average of three chirps each, in no particular order of author
+	for range users * 3 {
+		fixture.Chirps = append(fixture.Chirps, FixtureChirp{
+			Author: fixture.Users[r.IntN(users)].Email,
+			Body:   pick(fakeOpeners) + " " + pick(fakeVerbs) + " " + pick(fakeObjects) + pick(fakeEndings),
+		})
+	}
+
+	return fixture
+}
+
+// wipeDB removes the db at path and everything kept next to it, so the next
+// NewDB starts from nothing. Leaving the generations behind would bring the
+// old data back.
+func wipeDB(path string) error {
+	files := []string{path, path + ".log", path + ".lock"}
+	for i := 1; i <= snapshotGenerations; i++ {
+		files = append(files, generationPath(path, i))
+	}
+	for _, file := range files {
+		err := os.Remove(file)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// how many previous snapshots to keep around as database.json.1, .2, ...
+const snapshotGenerations = 3
+
+var errEmptySnapshot = errors.New("snapshot is empty")
+
+func generationPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// readSnapshot decrypts and decodes one snapshot file, upgrading it to the
+// current schema if needed. It reports whether the file should be rewritten
+// (migrated, or not sealed with the current key). An empty file is reported as
+// errEmptySnapshot: it is a new database unless older generations exist, in
+// which case something truncated it. Plaintext is only read with a key if
+// allowPlain, see dbCipher.open.
+func readSnapshot(path string, c *dbCipher, allowPlain bool) (DBStructure, bool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return DBStructure{}, false, err
+	}
+	if len(raw) == 0 {
+		return DBStructure{}, false, errEmptySnapshot
+	}
+
+	data, rekey, err := c.open(raw, allowPlain)
+	if err != nil {
+		return DBStructure{}, false, err
+	}
+	version, err := schemaVersionOf(data)
+	if err != nil {
+		return DBStructure{}, false, err
+	}
+	data, migrated, err := migrateSnapshot(path, data, raw)
+	if err != nil {
+		return DBStructure{}, false, err
+	}
+
+	dbData := newDBStructure()
+	err = json.Unmarshal(data, &dbData)
+	if err != nil {
+		return DBStructure{}, false, err
+	}
+	dbData.journalSchema = version
+	dbData.rebuildIndexes()
+
+	return dbData, migrated || rekey, nil
+}
+
+// loadNewestSnapshot tries path and then each generation in turn, returning
+// the first one that decodes and whether the file on disk is stale (it had to
+// fall back or migrate). A broken primary is moved aside to path.corrupt so it
+// can be looked at later and isn't overwritten by the next snapshot.
+func loadNewestSnapshot(path string, c *dbCipher, allowPlain bool) (DBStructure, bool, error) {
+	dbData, stale, err := readSnapshot(path, c, allowPlain)
+	if err == nil {
+		return dbData, stale, nil
+	}
+	if errors.Is(err, errSchemaTooNew) || errors.Is(err, errWrongKey) || errors.Is(err, errPlaintext) {
+		// falling back would throw away data that is fine, just not readable
+		// by this build or with this configuration
+		return DBStructure{}, false, err
+	}
+	primaryErr := err
+
+	for n := 1; n <= snapshotGenerations; n++ {
+		genPath := generationPath(path, n)
+		dbData, _, err = readSnapshot(genPath, c, allowPlain)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			log.Printf("Generation %s is unusable too: %s", genPath, err)
+			continue
+		}
+
+		log.Printf("%s is unusable (%s), recovering from %s at seq %d", path, primaryErr, genPath, dbData.Seq)
+		err = os.Rename(path, path+".corrupt")
+		if err != nil {
+			log.Printf("failed to move aside corrupt db file: %s", err)
+		}
+		return dbData, true, nil
+	}
+
+	if errors.Is(primaryErr, errEmptySnapshot) {
+		// no generations either, so this is a brand new db
+		return newDBStructure(), false, nil
+	}
+
+	return DBStructure{}, false, fmt.Errorf("%s is unusable and no valid generation was found: %w", path, primaryErr)
+}
+
+// writeSnapshot replaces path, keeping the previous file as generation 1 and
+// shifting older generations down.
+func writeSnapshot(path string, dbStructure DBStructure, c *dbCipher) error {
+	data, err := json.Marshal(dbStructure)
+	if err != nil {
+		return err
+	}
+
+	rotateGenerations(path)
+
+	return writeFileAtomic(path, c.seal(data))
+}
+
+// writeFileAtomic replaces path without ever leaving a half written file
+// behind: the data goes to a temp file that is synced and then renamed over
+// path.
+// resealOldFiles rewrites the generations, migration backups and moved aside
+// snapshots that aren't sealed with the primary key, so neither plaintext nor
+// a retired key lives on in them after encrypting or rotating. Files that no
+// configured key opens are left alone.
+func resealOldFiles(path string, c *dbCipher) error {
+	if c == nil {
+		return nil
+	}
+	files, err := filepath.Glob(path + ".v*.bak")
+	if err != nil {
+		return err
+	}
+	for n := 1; n <= snapshotGenerations; n++ {
+		files = append(files, generationPath(path, n))
+	}
+	files = append(files, path+".corrupt")
+
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) || len(raw) == 0 {
+			continue
+		} else if err != nil {
+			return err
+		}
+		plain, stale, err := c.open(raw, true)
+		if err != nil {
+			log.Printf("can't reseal %s: %s", file, err)
+			continue
+		}
+		if !stale {
+			continue
+		}
+		err = writeFileAtomic(file, c.seal(plain))
+		if err != nil {
+			return err
+		}
+		log.Printf("resealed %s with the current key", file)
+	}
+
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	syncDir(dir)
+
+	return nil
+}
+
+// rotateGenerations shifts path.1 -> path.2 and so on, then hard links the
+// current file as path.1. Linking instead of renaming means path itself is
+// never missing. Failures only cost us a generation, so they are just logged.
+func rotateGenerations(path string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	for n := snapshotGenerations - 1; n >= 1; n-- {
+		err := os.Rename(generationPath(path, n), generationPath(path, n+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("failed to rotate db generation %d: %s", n, err)
+		}
+	}
+
+	err := os.Remove(generationPath(path, 1))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("failed to remove db generation 1: %s", err)
+	}
+	err = os.Link(path, generationPath(path, 1))
+	if err != nil {
+		log.Printf("failed to keep previous db generation: %s", err)
+	}
+}
+
+// syncDir makes a rename durable. Not every platform supports it, which is fine.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
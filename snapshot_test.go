@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadFallsBackToOlderGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	// two snapshots: the second becomes database.json, the first .1
+	for i := range 2 {
+		db, err := NewDB(path, DBOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Update(UsersScope, func(tx Tx) error {
+			_, err := tx.CreateUser(string(rune('a'+i))+"@example.com", []byte("hash"))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cut off in the middle, like a write that never finished
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, data[:len(data)/2], 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path, DBOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if ids := userIds(t, db); !slices.Equal(ids, []int{1}) {
+		t.Errorf("recovered users %v, want [1] from %s.1", ids, path)
+	}
+	corrupt, err := os.ReadFile(path + ".corrupt")
+	if err != nil {
+		t.Fatalf("the broken snapshot wasn't kept: %s", err)
+	}
+	if len(corrupt) != len(data)/2 {
+		t.Errorf("%s.corrupt has %d bytes, want the %d that were left", path, len(corrupt), len(data)/2)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// staticDir holds everything under /app/ besides index.html
+const staticDir = "assets"
+
+// isPublicFile says whether the file server may hand out p, a path relative
+// to the working directory. Only the page and its assets are public: the same
+// directory also holds .env with the secrets, the db and its backups.
+func isPublicFile(p string) bool {
+	clean := path.Clean("/" + p)
+	if strings.Contains(clean, "/.") {
+		return false
+	}
+
+	return clean == "/" || clean == "/index.html" || clean == "/"+staticDir || strings.HasPrefix(clean, "/"+staticDir+"/")
+}
+
+// serveStatic only lets requests for public files through to next. The db
+// is kept out by name too, in case --db points into the assets.
+func serveStatic(dbFile string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isPublicFile(req.URL.Path) || strings.HasPrefix(path.Base(req.URL.Path), filepath.Base(dbFile)) {
+			http.NotFound(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// isServed says whether file would be handed out under /app/, so nothing
+// private gets written there
+func isServed(file string) bool {
+	wd, err := os.Getwd()
+	if err != nil {
+		return true
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return true
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+
+	return isPublicFile(filepath.ToSlash(rel))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeStatic(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":              "<html></html>",
+		"assets/logo.png":         "png",
+		"assets/.hidden":          "hidden",
+		".env":                    "JWT_SECRET=secret",
+		"database.json":           "{}",
+		"database.json.log":       "",
+		"backup.json":             "{}",
+		"goWebServer":             "binary",
+		"assets/database.json.1":  "{}",
+		"assets/nested/style.css": "css",
+	}
+	for name, content := range files {
+		err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := serveStatic("database.json", http.FileServer(http.Dir(dir)))
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/", http.StatusOK},
+		{"/index.html", http.StatusMovedPermanently},
+		{"/assets/logo.png", http.StatusOK},
+		{"/assets/nested/style.css", http.StatusOK},
+		{"/.env", http.StatusNotFound},
+		{"/assets/../.env", http.StatusNotFound},
+		{"/assets/.hidden", http.StatusNotFound},
+		{"/database.json", http.StatusNotFound},
+		{"/database.json.log", http.StatusNotFound},
+		{"/assets/database.json.1", http.StatusNotFound},
+		{"/backup.json", http.StatusNotFound},
+		{"/goWebServer", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/app"+test.path, nil)
+		req.URL.Path = test.path
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("GET %s: got %d, want %d", test.path, rec.Code, test.want)
+		}
+	}
+}
+
+func TestIsServed(t *testing.T) {
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"index.html", true},
+		{"assets/backup.json", true},
+		{"./assets/../assets/x", true},
+		{"backup.json", false},
+		{"../backup.json", false},
+		{"/tmp/backup.json", false},
+		{".env", false},
+	}
+	for _, test := range tests {
+		if got := isServed(test.file); got != test.want {
+			t.Errorf("isServed(%q) = %v, want %v", test.file, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+var (
+	ErrNotExist      = errors.New("record does not exist")
+	ErrAlreadyExists = errors.New("record already exists")
+	ErrForbidden     = errors.New("not allowed to change this record")
+	// ErrPreconditionFailed means the record changed since the client read it
+	ErrPreconditionFailed = errors.New("record has a different version")
+	// ErrBadReference means a new record points at one that doesn't exist
+	ErrBadReference = errors.New("referenced record does not exist")
+	// ErrInvalidSnapshot wraps whatever is wrong with a backup passed to Restore
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+// Scope says which collections a transaction touches. Only those are locked,
+// so transactions with disjoint scopes don't wait for each other.
+type Scope uint8
+
+const (
+	ChirpsScope Scope = 1 << iota
+	UsersScope
+	TokensScope
+
+	AllScopes = ChirpsScope | UsersScope | TokensScope
+)
+
+// the read-only flags of the collections sit above their normal ones
+const readOnlyShift = 3
+
+// ReadOnly marks collections that an Update only reads, e.g.
+// ChirpsScope|ReadOnly(UsersScope). They get a read lock instead of a write
+// lock, so readers of them don't wait for the transaction.
+func ReadOnly(scope Scope) Scope {
+	return scope << readOnlyShift
+}
+
+// Store is everything the handlers need from the data layer. Implementations
+// must be safe for concurrent use.
+type Store interface {
+	// View runs fn with a read-only Tx over the collections in scope
+	View(scope Scope, fn func(tx Tx) error) error
+	// Update runs fn with a writable Tx over the collections in scope and
+	// persists its changes only if fn returns nil. Any error leaves the data
+	// as it was.
+	Update(scope Scope, fn func(tx Tx) error) error
+	// Backup writes a consistent snapshot of every collection to w
+	Backup(w io.Writer) error
+	// BackupSealed is Backup encrypted with the store's key, errNoKey if it
+	// has none
+	BackupSealed(w io.Writer) error
+	// Restore replaces all data with a snapshot written by Backup or
+	// BackupSealed
+	Restore(r io.Reader) error
+	// Subscribe streams committed changes, see Event
+	Subscribe(seq uint64) (*Subscription, error)
+
+	Close() error
+}
+
+// Tx is the handle passed to View and Update. Changes made through it are
+// visible to later reads in the same transaction straight away, and are undone
+// if the function returns an error. Touching a collection outside the
+// transaction's scope is a programming error and panics.
+type Tx interface {
+	// chirps
+	Chirp(id int) (Chirp, error)
+	Chirps(q ChirpQuery) ([]Chirp, bool)
+	SearchChirps(q SearchQuery) []Chirp
+	CreateChirp(draft Chirp) (Chirp, error)
+	UpdateChirp(chirp Chirp) (Chirp, error)
+	ChirpHistory(id int) ([]ChirpRevision, error)
+	DeleteChirp(id int) error
+	Thread(id int) (ThreadNode, error)
+	LikeChirp(chirpId int, userId int) error
+	UnlikeChirp(chirpId int, userId int) error
+	LikedChirps(userId int) []Chirp
+
+	// chirps waiting for their publish_at
+	ScheduleChirp(draft Chirp, publishAt time.Time) (Chirp, error)
+	ScheduledChirp(id int) (Chirp, error)
+	ScheduledChirps(authorId int) []Chirp
+	RescheduleChirp(id int, publishAt time.Time) (Chirp, error)
+	UnscheduleChirp(id int) error
+	PublishDueChirps(now time.Time) (int, error)
+
+	// users
+	User(id int) (User, error)
+	UserByEmail(email string) (User, error)
+	CreateUser(email string, password []byte) (User, error)
+	UpdateUser(user User) (User, error)
+
+	// refresh tokens
+	RefreshToken(token string) (RefreshToken, error)
+	SaveRefreshToken(token string, refreshToken RefreshToken) error
+	DeleteRefreshToken(token string) error
+	PurgeExpiredRefreshTokens(now time.Time) (int, error)
+}
+
+func newDBStructure() DBStructure {
+	return DBStructure{
+		Chirps:        map[int]Chirp{},
+		Users:         map[int]User{},
+		Emails:        map[string]int{},
+		ChirpId:       0,
+		UserId:        0,
+		RefreshTokens: map[string]RefreshToken{},
+		ChirpHistory:  map[int][]ChirpRevision{},
+		Likes:         map[int][]int{},
+		Scheduled:     map[int]Chirp{},
+		SchemaVersion: currentSchemaVersion,
+		journalSchema: currentSchemaVersion,
+		idx:           newIndexes(),
+	}
+}
+
+// The methods below validate a change against the current state and describe
+// it as a journal entry; nothing changes until the entry is applied.
+
+// createChirp takes the body, author and references of draft and assigns the
+// rest
+func (s *DBStructure) createChirp(draft Chirp, now time.Time) (journalEntry, error) {
+	if _, ok := s.Chirps[draft.InReplyTo]; draft.InReplyTo != 0 && !ok {
+		return journalEntry{}, fmt.Errorf("%w: in_reply_to %d", ErrBadReference, draft.InReplyTo)
+	}
+	rechirpOf, err := s.originalOf(draft.RechirpOf)
+	if err != nil {
+		return journalEntry{}, fmt.Errorf("%w: rechirp_of %d", err, draft.RechirpOf)
+	}
+	quoteOf, err := s.originalOf(draft.QuoteOf)
+	if err != nil {
+		return journalEntry{}, fmt.Errorf("%w: quote_of %d", err, draft.QuoteOf)
+	}
+	for _, id := range s.idx.rechirps[rechirpOf] {
+		if s.Chirps[id].AuthorId == draft.AuthorId {
+			return journalEntry{}, ErrAlreadyExists
+		}
+	}
+	hashtags, mentions := s.tagsOf(draft.Body)
+
+	return journalEntry{
+		Op: opChirpCreated,
+		Chirp: &Chirp{
+			Id:        s.ChirpId + 1,
+			Body:      draft.Body,
+			AuthorId:  draft.AuthorId,
+			Version:   1,
+			InReplyTo: draft.InReplyTo,
+			RechirpOf: rechirpOf,
+			QuoteOf:   quoteOf,
+			Hashtags:  hashtags,
+			Mentions:  mentions,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+	}, nil
+}
+
+// originalOf follows a rechirp to the chirp it shares. 0 stays 0.
+func (s *DBStructure) originalOf(id int) (int, error) {
+	if id == 0 {
+		return 0, nil
+	}
+	chirp, ok := s.Chirps[id]
+	if !ok {
+		return 0, ErrBadReference
+	}
+	if chirp.RechirpOf != 0 {
+		return chirp.RechirpOf, nil
+	}
+
+	return id, nil
+}
+
+func (s *DBStructure) getChirp(id int) (Chirp, error) {
+	chirp, ok := s.Chirps[id]
+	if !ok {
+		return Chirp{}, ErrNotExist
+	}
+
+	return s.withCounts(chirp), nil
+}
+
+// withCounts fills in the fields that are derived from other chirps
+func (s *DBStructure) withCounts(chirp Chirp) Chirp {
+	chirp = s.counts(chirp)
+	original, ok := s.Chirps[max(chirp.RechirpOf, chirp.QuoteOf)]
+	if ok {
+		// only one level deep, the original's own original isn't included
+		original = s.counts(original)
+		chirp.Original = &original
+	}
+	return chirp
+}
+
+func (s *DBStructure) counts(chirp Chirp) Chirp {
+	chirp.ReplyCount = len(s.idx.replies[chirp.Id])
+	chirp.LikeCount = len(s.Likes[chirp.Id])
+	chirp.RechirpCount = len(s.idx.rechirps[chirp.Id])
+	chirp.QuoteCount = len(s.idx.quotes[chirp.Id])
+	return chirp
+}
+
+// restoreChirp is the entry that puts chirp id back exactly as it is now,
+// for undoing changes to it. The lists are copied since the indexes edit
+// theirs in place.
+func (s *DBStructure) restoreChirp(id int) journalEntry {
+	old := s.Chirps[id]
+	return journalEntry{
+		Op:      opChirpCreated,
+		Chirp:   &old,
+		History: slices.Clone(s.ChirpHistory[id]),
+		Likers:  slices.Clone(s.Likes[id]),
+	}
+}
+
+func (s *DBStructure) likeChirp(chirpId int, userId int) (journalEntry, bool, error) {
+	if _, ok := s.Chirps[chirpId]; !ok {
+		return journalEntry{}, false, ErrNotExist
+	}
+	_, liked := slices.BinarySearch(s.Likes[chirpId], userId)
+
+	return journalEntry{Op: opLikeAdded, Id: chirpId, UserId: userId}, !liked, nil
+}
+
+func (s *DBStructure) unlikeChirp(chirpId int, userId int) (journalEntry, bool, error) {
+	if _, ok := s.Chirps[chirpId]; !ok {
+		return journalEntry{}, false, ErrNotExist
+	}
+	_, liked := slices.BinarySearch(s.Likes[chirpId], userId)
+
+	return journalEntry{Op: opLikeRemoved, Id: chirpId, UserId: userId}, liked, nil
+}
+
+// ChirpQuery picks a page of chirps ordered by id
+type ChirpQuery struct {
+	// 0 for everyone's chirps
+	AuthorId int
+	// only chirps tagged with Hashtag and mentioning user MentionOf, if set
+	Hashtag   string
+	MentionOf int
+	// only chirps created at or after Since and before Until, if set
+	Since time.Time
+	Until time.Time
+	// After is a cursor: only chirps that come after this id in the chosen
+	// order are returned. It doesn't have to exist anymore, so pages stay
+	// stable when chirps are deleted in between. 0 starts at the beginning.
+	After int
+	// 0 for no limit
+	Limit int
+	Desc  bool
+}
+
+// queryChirps returns the page q asks for and whether there is more after it
+func (s *DBStructure) queryChirps(q ChirpQuery) ([]Chirp, bool) {
+	ids := s.idx.chirps
+	if q.AuthorId != 0 {
+		ids = s.idx.chirpsByAuthor[q.AuthorId]
+	}
+	if q.Hashtag != "" {
+		ids = intersectSorted(ids, s.idx.hashtags[q.Hashtag])
+	}
+	if q.MentionOf != 0 {
+		ids = intersectSorted(ids, s.idx.mentions[q.MentionOf])
+	}
+
+	// narrow ids down to the ones past the cursor, then walk them in order
+	if q.After != 0 {
+		i, found := slices.BinarySearch(ids, q.After)
+		if q.Desc {
+			ids = ids[:i]
+		} else if found {
+			ids = ids[i+1:]
+		} else {
+			ids = ids[i:]
+		}
+	}
+	chirps := []Chirp{}
+	for n := range ids {
+		id := ids[n]
+		if q.Desc {
+			id = ids[len(ids)-1-n]
+		}
+		chirp := s.Chirps[id]
+		// ids and times mostly agree, but a clock can go backwards, so this
+		// doesn't stop at the first chirp out of range
+		if !q.Since.IsZero() && chirp.CreatedAt.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && !chirp.CreatedAt.Before(q.Until) {
+			continue
+		}
+		if q.Limit > 0 && len(chirps) == q.Limit {
+			return chirps, true
+		}
+		chirps = append(chirps, s.withCounts(chirp))
+	}
+
+	return chirps, false
+}
+
+// updateChirp only takes the body from chirp, nothing else can be edited
+func (s *DBStructure) updateChirp(chirp Chirp, now time.Time) (journalEntry, error) {
+	old, ok := s.Chirps[chirp.Id]
+	if !ok {
+		return journalEntry{}, ErrNotExist
+	}
+	if old.RechirpOf != 0 {
+		// there is nothing to edit
+		return journalEntry{}, ErrForbidden
+	}
+	updated := old
+	updated.Body = chirp.Body
+	updated.Hashtags, updated.Mentions = s.tagsOf(chirp.Body)
+	updated.Version = old.Version + 1
+	updated.UpdatedAt = now
+
+	return journalEntry{Op: opChirpUpdated, Chirp: &updated, Time: now}, nil
+}
+
+func (s *DBStructure) deleteChirp(id int) (journalEntry, error) {
+	if _, ok := s.Chirps[id]; !ok {
+		return journalEntry{}, ErrNotExist
+	}
+
+	return journalEntry{Op: opChirpDeleted, Id: id}, nil
+}
+
+// scheduleChirp is createChirp for a chirp that waits until publishAt. Until
+// then its id is a scheduled id, which its author uses to reschedule or cancel
+// it. Rechirps can't wait, the original could be gone or rechirped by then.
+func (s *DBStructure) scheduleChirp(draft Chirp, publishAt time.Time, now time.Time) (journalEntry, error) {
+	if draft.RechirpOf != 0 {
+		return journalEntry{}, ErrForbidden
+	}
+	entry, err := s.createChirp(draft, now)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	entry.Op = opChirpScheduled
+	entry.Chirp.Id = s.ScheduledId + 1
+	entry.Chirp.PublishAt = publishAt
+
+	return entry, nil
+}
+
+func (s *DBStructure) getScheduledChirp(id int) (Chirp, error) {
+	chirp, ok := s.Scheduled[id]
+	if !ok {
+		return Chirp{}, ErrNotExist
+	}
+
+	return chirp, nil
+}
+
+func (s *DBStructure) rescheduleChirp(id int, publishAt time.Time) (journalEntry, error) {
+	chirp, ok := s.Scheduled[id]
+	if !ok {
+		return journalEntry{}, ErrNotExist
+	}
+	chirp.PublishAt = publishAt
+	chirp.Version++
+
+	return journalEntry{Op: opChirpScheduled, Chirp: &chirp}, nil
+}
+
+func (s *DBStructure) unscheduleChirp(id int) (journalEntry, error) {
+	if _, ok := s.Scheduled[id]; !ok {
+		return journalEntry{}, ErrNotExist
+	}
+
+	return journalEntry{Op: opChirpUnscheduled, Id: id}, nil
+}
+
+// scheduledChirps returns the queued chirps keep is true for, in the order
+// they go out
+func (s *DBStructure) scheduledChirps(keep func(chirp Chirp) bool) []Chirp {
+	chirps := []Chirp{}
+	for _, id := range sortedKeys(s.Scheduled) {
+		if keep(s.Scheduled[id]) {
+			chirps = append(chirps, s.Scheduled[id])
+		}
+	}
+	slices.SortStableFunc(chirps, func(a, b Chirp) int {
+		return a.PublishAt.Compare(b.PublishAt)
+	})
+
+	return chirps
+}
+
+func (s *DBStructure) createUser(email string, password []byte, now time.Time) (journalEntry, error) {
+	if _, ok := s.Emails[email]; ok {
+		return journalEntry{}, ErrAlreadyExists
+	}
+
+	return journalEntry{
+		Op: opUserCreated,
+		User: &User{
+			Id:          s.UserId + 1,
+			Email:       email,
+			Password:    password,
+			IsChirpyRed: false,
+			Version:     1,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		},
+	}, nil
+}
+
+func (s *DBStructure) getUser(id int) (User, error) {
+	user, ok := s.Users[id]
+	if !ok {
+		return User{}, ErrNotExist
+	}
+
+	return user, nil
+}
+
+func (s *DBStructure) getUserByEmail(email string) (User, error) {
+	id, ok := s.Emails[email]
+	if !ok {
+		return User{}, ErrNotExist
+	}
+
+	return s.getUser(id)
+}
+
+func (s *DBStructure) updateUser(user User, now time.Time) (journalEntry, error) {
+	old, ok := s.Users[user.Id]
+	if !ok {
+		return journalEntry{}, ErrNotExist
+	}
+	if id, ok := s.Emails[user.Email]; ok && id != user.Id {
+		return journalEntry{}, ErrAlreadyExists
+	}
+	user.Version = old.Version + 1
+	user.CreatedAt = old.CreatedAt
+	user.UpdatedAt = now
+
+	return journalEntry{Op: opUserUpdated, User: &user}, nil
+}
+
+func (s *DBStructure) saveRefreshToken(token string, refreshToken RefreshToken) journalEntry {
+	return journalEntry{Op: opTokenIssued, Token: token, RefreshToken: &refreshToken}
+}
+
+func (s *DBStructure) getRefreshToken(token string) (RefreshToken, error) {
+	refreshToken, ok := s.RefreshTokens[token]
+	if !ok {
+		return RefreshToken{}, ErrNotExist
+	}
+
+	return refreshToken, nil
+}
+
+func (s *DBStructure) deleteRefreshToken(token string) (journalEntry, error) {
+	if _, ok := s.RefreshTokens[token]; !ok {
+		return journalEntry{}, ErrNotExist
+	}
+
+	return journalEntry{Op: opTokenRevoked, Token: token}, nil
+}
+
+// ThreadNode is a chirp with its replies. A chirp that was deleted while
+// it had replies shows up with only its id and Deleted set: Chirp is nil and
+// left out, Id stands in for its id.
+type ThreadNode struct {
+	Id int `json:"id"`
+	*Chirp
+	Deleted bool         `json:"deleted,omitempty"`
+	Replies []ThreadNode `json:"replies"`
+}
+
+// thread walks up from id to the start of its conversation, or to the
+// first deleted chirp on the way, and returns everything below that
+func (s *DBStructure) thread(id int) (ThreadNode, error) {
+	chirp, ok := s.Chirps[id]
+	if !ok {
+		return ThreadNode{}, ErrNotExist
+	}
+	root := chirp.Id
+	for chirp.InReplyTo != 0 {
+		root = chirp.InReplyTo
+		chirp, ok = s.Chirps[root]
+		if !ok {
+			break
+		}
+	}
+
+	return s.threadNode(root), nil
+}
+
+func (s *DBStructure) threadNode(id int) ThreadNode {
+	node := ThreadNode{
+		Id:      id,
+		Replies: []ThreadNode{},
+	}
+	if chirp, ok := s.Chirps[id]; ok {
+		chirp = s.withCounts(chirp)
+		node.Chirp = &chirp
+	} else {
+		node.Deleted = true
+	}
+	for _, reply := range s.idx.replies[id] {
+		node.Replies = append(node.Replies, s.threadNode(reply))
+	}
+
+	return node
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// waitFor fails the test if done isn't closed within a second
+func waitFor(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s is still waiting", what)
+	}
+}
+
+func TestChirpWritesOnlyReadLockUsers(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+	err := store.Update(UsersScope, func(tx Tx) error {
+		_, err := tx.CreateUser("ada@example.com", []byte("hash"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		err := store.Update(ChirpsScope|ReadOnly(UsersScope), func(tx Tx) error {
+			chirp, err := tx.CreateChirp(Chirp{Body: "hi @ada", AuthorId: 1})
+			if err == nil && len(chirp.Mentions) != 1 {
+				t.Errorf("mentions = %v, want [1]", chirp.Mentions)
+			}
+			close(inside)
+			<-release
+			return err
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	waitFor(t, inside, "the chirp transaction")
+
+	// a login only reads users, it must not wait for the chirp
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		store.View(UsersScope, func(tx Tx) error {
+			_, err := tx.UserByEmail("ada@example.com")
+			return err
+		})
+	}()
+	waitFor(t, read, "reading users")
+	close(release)
+	waitFor(t, finished, "the chirp transaction")
+}
+
+func TestReadOnlyScopeRefusesWrites(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("creating a user with users read-only didn't panic")
+		}
+	}()
+	store.Update(ChirpsScope|ReadOnly(UsersScope), func(tx Tx) error {
+		_, err := tx.CreateUser("ada@example.com", []byte("hash"))
+		return err
+	})
+}
+
+// A scheduled chirp goes out after chirps posted while it waited, so it must
+// come after them in feeds, including for a client paging with a cursor.
+func TestPublishedChirpsGetTheNextId(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	scheduled := Chirp{}
+	err := store.Update(ChirpsScope|UsersScope, func(tx Tx) error {
+		_, err := tx.CreateUser("ada@example.com", []byte("hash"))
+		if err != nil {
+			return err
+		}
+		scheduled, err = tx.ScheduleChirp(Chirp{Body: "later", AuthorId: 1}, time.Now().Add(time.Hour))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateChirp(Chirp{Body: "now", AuthorId: 1})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(ChirpsScope, func(tx Tx) error {
+		_, err := tx.PublishDueChirps(time.Now().Add(2 * time.Hour))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.View(ChirpsScope, func(tx Tx) error {
+		chirps, _ := tx.Chirps(ChirpQuery{After: 1})
+		if len(chirps) != 1 || chirps[0].Body != "later" || chirps[0].Id != 2 {
+			t.Errorf("chirps after 1 = %+v, want the published chirp with id 2", chirps)
+		}
+		if _, err := tx.ScheduledChirp(scheduled.Id); err == nil {
+			t.Errorf("scheduled chirp %d is still queued", scheduled.Id)
+		}
+		return nil
+	})
+	if violations := store.data.check(); len(violations) > 0 {
+		t.Errorf("check found %+v", violations)
+	}
+}
+
+func TestPublishDropsReferencesToDeletedChirps(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	err := store.Update(ChirpsScope|UsersScope, func(tx Tx) error {
+		_, err := tx.CreateUser("ada@example.com", []byte("hash"))
+		if err != nil {
+			return err
+		}
+		original, err := tx.CreateChirp(Chirp{Body: "original", AuthorId: 1})
+		if err != nil {
+			return err
+		}
+		publishAt := time.Now().Add(time.Hour)
+		_, err = tx.ScheduleChirp(Chirp{Body: "reply", AuthorId: 1, InReplyTo: original.Id}, publishAt)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ScheduleChirp(Chirp{Body: "quote", AuthorId: 1, QuoteOf: original.Id}, publishAt)
+		if err != nil {
+			return err
+		}
+		return tx.DeleteChirp(original.Id)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(ChirpsScope, func(tx Tx) error {
+		published, err := tx.PublishDueChirps(time.Now().Add(2 * time.Hour))
+		if err == nil && published != 2 {
+			t.Errorf("published %d chirps, want 2", published)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.View(ChirpsScope, func(tx Tx) error {
+		chirps, _ := tx.Chirps(ChirpQuery{})
+		for _, chirp := range chirps {
+			if chirp.InReplyTo != 0 || chirp.QuoteOf != 0 {
+				t.Errorf("published %+v still points at the deleted chirp", chirp)
+			}
+		}
+		return nil
+	})
+	if violations := store.data.check(); len(violations) > 0 {
+		t.Errorf("check found %+v", violations)
+	}
+}
+
+func TestPanicInUpdateRollsBackAndUnlocks(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("reading tokens outside the scope didn't panic")
+			}
+		}()
+		store.Update(UsersScope, func(tx Tx) error {
+			_, err := tx.CreateUser("ada@example.com", []byte("hash"))
+			if err != nil {
+				return err
+			}
+			tx.RefreshToken("token")
+			return nil
+		})
+	}()
+
+	viewed := make(chan struct{})
+	go func() {
+		defer close(viewed)
+		store.View(AllScopes, func(tx Tx) error {
+			if _, err := tx.UserByEmail("ada@example.com"); err == nil {
+				t.Error("the user created before the panic is still there")
+			}
+			return nil
+		})
+	}()
+	waitFor(t, viewed, "a view after the panic")
+}
+
+func TestMentionsFollowEmailChanges(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	mentionsOf := func(body string) []int {
+		t.Helper()
+		chirp := Chirp{}
+		err := store.Update(ChirpsScope|ReadOnly(UsersScope), func(tx Tx) error {
+			var err error
+			chirp, err = tx.CreateChirp(Chirp{Body: body, AuthorId: 1})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chirp.Mentions
+	}
+
+	err := store.Update(UsersScope, func(tx Tx) error {
+		for _, email := range []string{"ada@example.com", "Ada@example.org", "alan@example.com"} {
+			_, err := tx.CreateUser(email, []byte("hash"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two users are @ada, so it mentions nobody
+	if got := mentionsOf("@ada @alan"); !slices.Equal(got, []int{3}) {
+		t.Errorf("mentions = %v, want [3]", got)
+	}
+
+	err = store.Update(UsersScope, func(tx Tx) error {
+		user, err := tx.User(2)
+		if err != nil {
+			return err
+		}
+		user.Email = "grace@example.org"
+		_, err = tx.UpdateUser(user)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mentionsOf("@ada @grace"); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("mentions after the email change = %v, want [1 2]", got)
+	}
+}
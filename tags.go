@@ -0,0 +1,110 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+// email local parts can have a few more characters than tags
+func isHandleRune(r rune) bool {
+	return isTagRune(r) || r == '.' || r == '-' || r == '+'
+}
+
+// startsWord is true if a tag at i would be a word of its own, so the @ in an
+// email address or the # in a url fragment doesn't count
+func startsWord(runes []rune, i int) bool {
+	return i == 0 || unicode.IsSpace(runes[i-1]) || strings.ContainsRune(`("'[`, runes[i-1])
+}
+
+// extractTags finds the #hashtags and @handles in a body, lower cased and
+// without repeats, in the order they first appear
+func extractTags(body string) ([]string, []string) {
+	hashtags := []string{}
+	handles := []string{}
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if (r != '#' && r != '@') || !startsWord(runes, i) {
+			continue
+		}
+		valid := isTagRune
+		if r == '@' {
+			valid = isHandleRune
+		}
+		end := i + 1
+		for end < len(runes) && valid(runes[end]) {
+			end++
+		}
+		// "cc @ada." ends the sentence, not the handle
+		word := strings.TrimRight(string(runes[i+1:end]), ".-")
+		i = end - 1
+		if word == "" {
+			continue
+		}
+		word = strings.ToLower(word)
+		if r == '#' && !slices.Contains(hashtags, word) {
+			hashtags = append(hashtags, word)
+		} else if r == '@' && !slices.Contains(handles, word) {
+			handles = append(handles, word)
+		}
+	}
+
+	return hashtags, handles
+}
+
+// normalizeHashtag turns what a client asks for, with or without the #, into
+// the form extractTags stores. It's empty if tag isn't a hashtag.
+func normalizeHashtag(tag string) string {
+	tag = strings.TrimPrefix(tag, "#")
+	if tag == "" || strings.IndexFunc(tag, func(r rune) bool { return !isTagRune(r) }) != -1 {
+		return ""
+	}
+
+	return strings.ToLower(tag)
+}
+
+// handleOf is the part of an email before the @, lower cased, which is what
+// @mentions refer to
+func handleOf(email string) string {
+	handle, _, _ := strings.Cut(email, "@")
+	return strings.ToLower(handle)
+}
+
+// resolveMentions turns handles into user ids, looking them up in owners
+// (handle -> ids of the users with it). A handle only mentions someone if
+// exactly one user has it; anything else stays plain text.
+func resolveMentions(handles []string, owners map[string][]int) []int {
+	if len(handles) == 0 {
+		return nil
+	}
+
+	mentions := []int{}
+	for _, handle := range handles {
+		ids := owners[handle]
+		if len(ids) == 1 && !slices.Contains(mentions, ids[0]) {
+			mentions = append(mentions, ids[0])
+		}
+	}
+
+	return mentions
+}
+
+// tagsOf extracts the hashtags and mentions of a body about to be saved.
+// Empty lists come back nil so they are left out of the record.
+func (s *DBStructure) tagsOf(body string) ([]string, []int) {
+	hashtags, handles := extractTags(body)
+	mentions := resolveMentions(handles, s.idx.handles)
+	if len(hashtags) == 0 {
+		hashtags = nil
+	}
+	if len(mentions) == 0 {
+		mentions = nil
+	}
+
+	return hashtags, mentions
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+var ErrReadOnly = errors.New("write in a read-only transaction")
+
+// dbTx is the Tx of a DB. It works on the DBStructure directly and keeps the
+// journal entries to commit and the inverse entries to roll back with.
+type dbTx struct {
+	data     *DBStructure
+	scope    Scope
+	writable bool
+	entries  []journalEntry
+	undo     []journalEntry
+	// counters only ever grow through apply, so rolling back restores them
+	chirpId     int
+	scheduledId int
+	userId      int
+}
+
+func newTx(data *DBStructure, scope Scope, writable bool) *dbTx {
+	tx := &dbTx{
+		data:     data,
+		scope:    scope,
+		writable: writable,
+	}
+	// only read what this transaction has locked
+	if scope&ChirpsScope != 0 {
+		tx.chirpId = data.ChirpId
+		tx.scheduledId = data.ScheduledId
+	}
+	if scope&UsersScope != 0 {
+		tx.userId = data.UserId
+	}
+
+	return tx
+}
+
+func (tx *dbTx) need(scope Scope) {
+	readable := tx.scope | tx.scope>>readOnlyShift
+	if readable&scope != scope {
+		panic(fmt.Sprintf("transaction with scope %b used collection %b", tx.scope, scope))
+	}
+}
+
+// scopeOf is the collection an op writes to
+func scopeOf(op string) Scope {
+	switch op {
+	case opUserCreated, opUserUpdated, opUserDeleted:
+		return UsersScope
+	case opTokenIssued, opTokenRevoked:
+		return TokensScope
+	default:
+		return ChirpsScope
+	}
+}
+
+// record applies entry and remembers how to take it back
+func (tx *dbTx) record(entry journalEntry, inverse journalEntry) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	if tx.scope&scopeOf(entry.Op) == 0 {
+		panic(fmt.Sprintf("transaction with scope %b wrote %s", tx.scope, entry.Op))
+	}
+	err := tx.data.apply(entry)
+	if err != nil {
+		return err
+	}
+	tx.entries = append(tx.entries, entry)
+	tx.undo = append(tx.undo, inverse)
+
+	return nil
+}
+
+func (tx *dbTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.data.apply(tx.undo[i])
+	}
+	if tx.scope&ChirpsScope != 0 {
+		tx.data.ChirpId = tx.chirpId
+		tx.data.ScheduledId = tx.scheduledId
+	}
+	if tx.scope&UsersScope != 0 {
+		tx.data.UserId = tx.userId
+	}
+	tx.entries = nil
+	tx.undo = nil
+}
+
+func (tx *dbTx) Chirp(id int) (Chirp, error) {
+	tx.need(ChirpsScope)
+	return tx.data.getChirp(id)
+}
+
+// Chirps returns the page of chirps q asks for, and whether there are more
+func (tx *dbTx) Chirps(q ChirpQuery) ([]Chirp, bool) {
+	tx.need(ChirpsScope)
+	return tx.data.queryChirps(q)
+}
+
+// SearchChirps returns the chirps matching q, best or newest first
+func (tx *dbTx) SearchChirps(q SearchQuery) []Chirp {
+	tx.need(ChirpsScope)
+	return tx.data.searchChirps(q)
+}
+
+// CreateChirp saves a new chirp with the body, author and references of draft
+func (tx *dbTx) CreateChirp(draft Chirp) (Chirp, error) {
+	// users are only read, to resolve mentions, so ReadOnly(UsersScope) does
+	tx.need(ChirpsScope | UsersScope)
+	entry, err := tx.data.createChirp(draft, time.Now().UTC())
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.record(entry, journalEntry{Op: opChirpDeleted, Id: entry.Chirp.Id})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return tx.data.withCounts(*entry.Chirp), nil
+}
+
+// ScheduleChirp queues a chirp like CreateChirp would make it, to be published
+// by PublishDueChirps once publishAt has passed
+func (tx *dbTx) ScheduleChirp(draft Chirp, publishAt time.Time) (Chirp, error) {
+	tx.need(ChirpsScope | UsersScope)
+	entry, err := tx.data.scheduleChirp(draft, publishAt, time.Now().UTC())
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.record(entry, journalEntry{Op: opChirpUnscheduled, Id: entry.Chirp.Id})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return *entry.Chirp, nil
+}
+
+// ScheduledChirp returns a chirp that hasn't been published yet
+func (tx *dbTx) ScheduledChirp(id int) (Chirp, error) {
+	tx.need(ChirpsScope)
+	return tx.data.getScheduledChirp(id)
+}
+
+// ScheduledChirps returns an author's queued chirps, the next one first
+func (tx *dbTx) ScheduledChirps(authorId int) []Chirp {
+	tx.need(ChirpsScope)
+	return tx.data.scheduledChirps(func(chirp Chirp) bool {
+		return chirp.AuthorId == authorId
+	})
+}
+
+// RescheduleChirp moves a queued chirp to publishAt
+func (tx *dbTx) RescheduleChirp(id int, publishAt time.Time) (Chirp, error) {
+	tx.need(ChirpsScope)
+	entry, err := tx.data.rescheduleChirp(id, publishAt)
+	if err != nil {
+		return Chirp{}, err
+	}
+	old := tx.data.Scheduled[id]
+	err = tx.record(entry, journalEntry{Op: opChirpScheduled, Chirp: &old})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return *entry.Chirp, nil
+}
+
+// UnscheduleChirp cancels a queued chirp
+func (tx *dbTx) UnscheduleChirp(id int) error {
+	tx.need(ChirpsScope)
+	entry, err := tx.data.unscheduleChirp(id)
+	if err != nil {
+		return err
+	}
+	old := tx.data.Scheduled[id]
+
+	return tx.record(entry, journalEntry{Op: opChirpScheduled, Chirp: &old})
+}
+
+// PublishDueChirps publishes every queued chirp whose publish_at is not after
+// now. They get the next chirp ids in the order they were due, and are created
+// as of now, so they come after everything posted before.
+func (tx *dbTx) PublishDueChirps(now time.Time) (int, error) {
+	tx.need(ChirpsScope)
+	due := tx.data.scheduledChirps(func(chirp Chirp) bool {
+		return !chirp.PublishAt.After(now)
+	})
+	for _, chirp := range due {
+		err := tx.UnscheduleChirp(chirp.Id)
+		if err != nil {
+			return 0, err
+		}
+		// what it answers or quotes may have been deleted while it waited
+		if _, ok := tx.data.Chirps[chirp.InReplyTo]; chirp.InReplyTo != 0 && !ok {
+			log.Printf("scheduled chirp %d: in_reply_to %d is gone, dropping it", chirp.Id, chirp.InReplyTo)
+			chirp.InReplyTo = 0
+		}
+		if _, ok := tx.data.Chirps[chirp.QuoteOf]; chirp.QuoteOf != 0 && !ok {
+			log.Printf("scheduled chirp %d: quote_of %d is gone, dropping it", chirp.Id, chirp.QuoteOf)
+			chirp.QuoteOf = 0
+		}
+		chirp.Id = tx.data.ChirpId + 1
+		chirp.PublishAt = time.Time{}
+		chirp.CreatedAt = now.UTC()
+		chirp.UpdatedAt = now.UTC()
+		err = tx.record(journalEntry{Op: opChirpCreated, Chirp: &chirp}, journalEntry{Op: opChirpDeleted, Id: chirp.Id})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(due), nil
+}
+
+// Thread returns the whole conversation chirp id is part of
+func (tx *dbTx) Thread(id int) (ThreadNode, error) {
+	tx.need(ChirpsScope)
+	return tx.data.thread(id)
+}
+
+// UpdateChirp saves chirp, keeping what it replaces as a revision, and
+// returns it with its new version
+func (tx *dbTx) UpdateChirp(chirp Chirp) (Chirp, error) {
+	tx.need(ChirpsScope | UsersScope)
+	entry, err := tx.data.updateChirp(chirp, time.Now().UTC())
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.record(entry, tx.data.restoreChirp(chirp.Id))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return tx.data.withCounts(*entry.Chirp), nil
+}
+
+// ChirpHistory returns the earlier revisions of a chirp, oldest first
+func (tx *dbTx) ChirpHistory(id int) ([]ChirpRevision, error) {
+	tx.need(ChirpsScope)
+	_, err := tx.data.getChirp(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]ChirpRevision{}, tx.data.ChirpHistory[id]...), nil
+}
+
+// DeleteChirp deletes a chirp and every rechirp of it, since those are
+// nothing without it. Quotes stay.
+func (tx *dbTx) DeleteChirp(id int) error {
+	tx.need(ChirpsScope)
+	entry, err := tx.data.deleteChirp(id)
+	if err != nil {
+		return err
+	}
+	for _, rechirp := range slices.Clone(tx.data.idx.rechirps[id]) {
+		err = tx.DeleteChirp(rechirp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.record(entry, tx.data.restoreChirp(id))
+}
+
+// LikeChirp records that a user likes a chirp. Liking it again is fine and
+// changes nothing.
+func (tx *dbTx) LikeChirp(chirpId int, userId int) error {
+	tx.need(ChirpsScope)
+	entry, changes, err := tx.data.likeChirp(chirpId, userId)
+	if err != nil || !changes {
+		return err
+	}
+
+	return tx.record(entry, journalEntry{Op: opLikeRemoved, Id: chirpId, UserId: userId})
+}
+
+// UnlikeChirp takes a like back, if there was one
+func (tx *dbTx) UnlikeChirp(chirpId int, userId int) error {
+	tx.need(ChirpsScope)
+	entry, changes, err := tx.data.unlikeChirp(chirpId, userId)
+	if err != nil || !changes {
+		return err
+	}
+
+	return tx.record(entry, journalEntry{Op: opLikeAdded, Id: chirpId, UserId: userId})
+}
+
+// LikedChirps returns the chirps a user liked, ordered by id
+func (tx *dbTx) LikedChirps(userId int) []Chirp {
+	tx.need(ChirpsScope)
+	chirps := []Chirp{}
+	for _, id := range tx.data.idx.likesByUser[userId] {
+		chirps = append(chirps, tx.data.withCounts(tx.data.Chirps[id]))
+	}
+
+	return chirps
+}
+
+func (tx *dbTx) User(id int) (User, error) {
+	tx.need(UsersScope)
+	return tx.data.getUser(id)
+}
+
+func (tx *dbTx) UserByEmail(email string) (User, error) {
+	tx.need(UsersScope)
+	return tx.data.getUserByEmail(email)
+}
+
+func (tx *dbTx) CreateUser(email string, password []byte) (User, error) {
+	tx.need(UsersScope)
+	entry, err := tx.data.createUser(email, password, time.Now().UTC())
+	if err != nil {
+		return User{}, err
+	}
+	err = tx.record(entry, journalEntry{Op: opUserDeleted, Id: entry.User.Id})
+	if err != nil {
+		return User{}, err
+	}
+
+	return *entry.User, nil
+}
+
+// UpdateUser saves user and returns it with its new version
+func (tx *dbTx) UpdateUser(user User) (User, error) {
+	tx.need(UsersScope)
+	entry, err := tx.data.updateUser(user, time.Now().UTC())
+	if err != nil {
+		return User{}, err
+	}
+	old := tx.data.Users[user.Id]
+	err = tx.record(entry, journalEntry{Op: opUserUpdated, User: &old})
+	if err != nil {
+		return User{}, err
+	}
+
+	return *entry.User, nil
+}
+
+func (tx *dbTx) RefreshToken(token string) (RefreshToken, error) {
+	tx.need(TokensScope)
+	return tx.data.getRefreshToken(token)
+}
+
+func (tx *dbTx) SaveRefreshToken(token string, refreshToken RefreshToken) error {
+	tx.need(TokensScope)
+	inverse := journalEntry{Op: opTokenRevoked, Token: token}
+	if old, ok := tx.data.RefreshTokens[token]; ok {
+		inverse = journalEntry{Op: opTokenIssued, Token: token, RefreshToken: &old}
+	}
+
+	return tx.record(tx.data.saveRefreshToken(token, refreshToken), inverse)
+}
+
+// PurgeExpiredRefreshTokens deletes every refresh token that expired before now
+func (tx *dbTx) PurgeExpiredRefreshTokens(now time.Time) (int, error) {
+	tx.need(TokensScope)
+	expired := []string{}
+	for token, refreshToken := range tx.data.RefreshTokens {
+		if refreshToken.Expiration < now.Unix() {
+			expired = append(expired, token)
+		}
+	}
+
+	for _, token := range expired {
+		err := tx.DeleteRefreshToken(token)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+func (tx *dbTx) DeleteRefreshToken(token string) error {
+	tx.need(TokensScope)
+	entry, err := tx.data.deleteRefreshToken(token)
+	if err != nil {
+		return err
+	}
+	old := tx.data.RefreshTokens[token]
+
+	return tx.record(entry, journalEntry{Op: opTokenIssued, Token: token, RefreshToken: &old})
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"log"
 	"net/http"
@@ -81,3 +83,67 @@ func (apiCfg *apiConfig) generateJWT(currentTime time.Time, expires int64, id in
 
 	return signedToken
 }
+
+// requestUserId is the user in the request's JWT, if it has a valid one
+func (apiCfg *apiConfig) requestUserId(req *http.Request) (int, bool) {
+	claims := jwt.RegisteredClaims{}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	parsedToken, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(apiCfg.jwtSecret), nil
+	})
+	if err != nil {
+		return 0, false
+	}
+	subject, _ := parsedToken.Claims.GetSubject()
+	id, err := strconv.Atoi(subject)
+
+	return id, err == nil
+}
+
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// chirpETag is etag plus a hash of the whole chirp, since its counts and the
+// original it embeds change without its version going up
+func chirpETag(chirp Chirp) string {
+	data, _ := json.Marshal(chirp)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf(`"%d-%x"`, chirp.Version, sum[:6])
+}
+
+// etagMatches checks an If-None-Match header against the ETag of a response.
+// It compares weakly, so W/ tags count.
+func etagMatches(header string, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkIfMatch is for use inside an Update: a request with If-Match only
+// goes ahead if the record is still at a version the client listed. Only the
+// version in each tag is compared, a chirp getting a like isn't a reason to
+// refuse an edit.
+func checkIfMatch(req *http.Request, version int) error {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil
+		}
+		tagVersion, _, _ := strings.Cut(strings.Trim(tag, `"`), "-")
+		if tagVersion == strconv.Itoa(version) && strings.HasPrefix(tag, `"`) {
+			return nil
+		}
+	}
+
+	return ErrPreconditionFailed
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChirpETagCoversCounts(t *testing.T) {
+	chirp := Chirp{Id: 1, Body: "hello", AuthorId: 1, Version: 1}
+	before := chirpETag(chirp)
+	chirp.LikeCount = 1
+	after := chirpETag(chirp)
+
+	if before == after {
+		t.Fatalf("ETag %s didn't change with the like count", before)
+	}
+	if etagMatches(before, after) {
+		t.Errorf("If-None-Match: %s matched %s", before, after)
+	}
+	if !etagMatches("W/"+after, after) {
+		t.Errorf("If-None-Match: W/%s didn't match %s", after, after)
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	chirp := Chirp{Id: 1, Version: 2, LikeCount: 5}
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"", true},
+		{"*", true},
+		{etag(2), true},
+		{chirpETag(chirp), true},
+		// likes came in since the client read the chirp
+		{chirpETag(Chirp{Id: 1, Version: 2}), true},
+		{`"1", "2-abc"`, true},
+		{etag(1), false},
+		{`"1-abc"`, false},
+		{"W/" + etag(2), false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("PUT", "/api/chirps/1", nil)
+		if test.header != "" {
+			req.Header.Set("If-Match", test.header)
+		}
+		err := checkIfMatch(req, chirp.Version)
+		if (err == nil) != test.ok {
+			t.Errorf("If-Match %s: got %v", test.header, err)
+		}
+	}
+}